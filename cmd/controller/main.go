@@ -19,25 +19,23 @@ import (
 	"flag"
 	"log"
 	"os"
-	"time"
 
 	"github.com/kelseyhightower/envconfig"
-	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
-	externalversions "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/discovery"
 	"knative.dev/pkg/injection"
 	"knative.dev/pkg/injection/sharedmain"
 	"knative.dev/pkg/signals"
+	"knative.dev/pkg/webhook"
+	"knative.dev/pkg/webhook/certificates"
 
 	"github.com/lionelvillard/knative-functions-controller/pkg/dynamic"
+	"github.com/lionelvillard/knative-functions-controller/pkg/leaderelection"
 	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/crds"
-	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/functions"
 )
 
 type envConfig struct {
 	Namespace string `envconfig:"SYSTEM_NAMESPACE" default:"default"`
+	PodName   string `envconfig:"POD_NAME"`
 }
 
 var (
@@ -48,91 +46,48 @@ var (
 func main() {
 	flag.Parse()
 
-	// Load functions CRDs.
-
 	cfg, err := sharedmain.GetConfig(*masterURL, *kubeconfig)
 	if err != nil {
 		log.Fatal("Error building kubeconfig", err)
 	}
 
-	clientset := apiextensionsclientset.NewForConfigOrDie(cfg)
-	defs, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().List(metav1.ListOptions{
-		LabelSelector: "functions.knative.dev/crd=true",
-	})
-
-	if err != nil {
-		log.Fatal("Error listing custom resource definitions", err)
-	}
-
 	var env envConfig
 	err = envconfig.Process("", &env)
 	if err != nil {
 		log.Fatalf("Error processing environment: %v", err)
 	}
 
-	// Create a controller per function CRD.
-
-	controllers := make([]injection.ControllerConstructor, len(defs.Items)+1)
-	controllers[0] = crds.NewController
+	// Watch CRDs with the most recent API served by the cluster.
+	crdGVR, err := crds.CRDResource(discovery.NewDiscoveryClientForConfigOrDie(cfg))
+	if err != nil {
+		log.Fatal("Error discovering the custom resource definition API", err)
+	}
+	injection.Default.RegisterInformer(dynamic.WithInformer(crdGVR))
 
-	names := make([]string, len(defs.Items))
-	for i, crd := range defs.Items {
-		gvr := schema.GroupVersionResource{
-			Group:    crd.Spec.Group,
-			Version:  crd.Spec.Version,
-			Resource: crd.Spec.Names.Plural,
+	identity := env.PodName
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("Error getting the hostname: %v", err)
 		}
-		names[i] = crd.Name
-
-		injection.Default.RegisterInformer(dynamic.WithInformer(gvr))
-		controllers[i+1] = functions.NewController(gvr)
 	}
 
-	// Watch for any CRD changes
-	ctx := signals.NewContext()
-
-	f := externalversions.NewSharedInformerFactory(clientset, time.Hour)
-	crdInformer := f.Apiextensions().V1beta1().CustomResourceDefinitions().Informer()
-	crdInformer.AddEventHandler(newHandler(names))
-	go crdInformer.Run(ctx.Done())
-
-	sharedmain.MainWithConfig(ctx, "controller", cfg, controllers...)
-
-	<-ctx.Done()
-}
-
-func newHandler(names []string) cache.ResourceEventHandler {
-	return cache.FilteringResourceEventHandler{
-		FilterFunc: func(obj interface{}) bool {
-			if object, ok := obj.(metav1.Object); ok {
-				if labels := object.GetLabels(); labels != nil {
-					if v, ok := labels["functions.knative.dev/crd"]; ok && v == "true" {
-						for _, name := range names {
-							if name == object.GetName() {
-								return false
-							}
-						}
-
-						return true
-					}
-				}
-			}
-			return false
-		},
-		Handler: restartResourceHandler{}}
-}
-
-type restartResourceHandler struct{}
-
-func (r restartResourceHandler) OnAdd(obj interface{}) {
-	// TODO: close channel
-	os.Exit(0)
-}
-
-func (r restartResourceHandler) OnUpdate(oldObj, newObj interface{}) {
-	os.Exit(0)
-}
+	ctx := webhook.WithOptions(signals.NewContext(), webhook.Options{
+		ServiceName: "functions-webhook",
+		SecretName:  "functions-webhook-certs",
+		Port:        8443,
+	})
 
-func (r restartResourceHandler) OnDelete(obj interface{}) {
-	os.Exit(0)
+	// Only the elected replica runs the CRD controller. Function controllers
+	// are started and stopped by the CRD controller as function CRDs come and go.
+	// All replicas serve the webhook denying the deletion of function CRDs
+	// while instances remain.
+	sharedmain.MainWithConfig(ctx, "controller", cfg,
+		leaderelection.NewController(leaderelection.Config{
+			LeaseName: "functions-controller",
+			Namespace: env.Namespace,
+			Identity:  identity,
+		}, crds.NewController(crdGVR)),
+		certificates.NewController,
+		crds.NewAdmissionController(crdGVR))
 }
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CustomResourceDefinition is a skeleton type wrapping the CRDs defining
+// functions. It can be read from both apiextensions.k8s.io/v1 and
+// apiextensions.k8s.io/v1beta1.
+type CustomResourceDefinition struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              CustomResourceDefinitionSpec `json:"spec"`
+}
+
+type CustomResourceDefinitionSpec struct {
+	// Group is the API group of the function.
+	Group string `json:"group"`
+
+	// Names specify the resource and kind names of the function.
+	Names CustomResourceDefinitionNames `json:"names"`
+
+	// Scope indicates whether the function is cluster or namespace scoped.
+	Scope string `json:"scope"`
+
+	// Version is the single version of the function. Only set by apiextensions.k8s.io/v1beta1.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Versions is the list of all supported versions of the function.
+	// +optional
+	Versions []CustomResourceDefinitionVersion `json:"versions,omitempty"`
+}
+
+type CustomResourceDefinitionNames struct {
+	Plural   string `json:"plural"`
+	Singular string `json:"singular,omitempty"`
+	Kind     string `json:"kind"`
+	ListKind string `json:"listKind,omitempty"`
+}
+
+type CustomResourceDefinitionVersion struct {
+	Name    string `json:"name"`
+	Served  bool   `json:"served"`
+	Storage bool   `json:"storage"`
+}
+
+// ServedVersions returns the versions of the function served by the API
+// server, from the most to the least preferred.
+func (crd *CustomResourceDefinition) ServedVersions() []string {
+	versions := []string{}
+	for _, v := range crd.Spec.Versions {
+		if v.Served {
+			versions = append(versions, v.Name)
+		}
+	}
+	if len(crd.Spec.Versions) == 0 && crd.Spec.Version != "" {
+		versions = append(versions, crd.Spec.Version)
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return version.CompareKubeAwareVersionStrings(versions[i], versions[j]) > 0
+	})
+	return versions
+}
+
+// StorageVersion returns the version used to persist the function instances.
+func (crd *CustomResourceDefinition) StorageVersion() string {
+	for _, v := range crd.Spec.Versions {
+		if v.Storage {
+			return v.Name
+		}
+	}
+	return crd.Spec.Version
+}
+
+// PreferredVersion returns the version to use to watch and update the
+// function instances: the storage version when served, otherwise the
+// most preferred served version. It returns the empty string when no
+// version is served.
+func (crd *CustomResourceDefinition) PreferredVersion() string {
+	served := crd.ServedVersions()
+	storage := crd.StorageVersion()
+	for _, v := range served {
+		if v == storage {
+			return v
+		}
+	}
+	if len(served) > 0 {
+		return served[0]
+	}
+	return ""
+}
+
+// FunctionResource returns the resource of the function instances at the
+// preferred version.
+func (crd *CustomResourceDefinition) FunctionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    crd.Spec.Group,
+		Version:  crd.PreferredVersion(),
+		Resource: crd.Spec.Names.Plural,
+	}
+}
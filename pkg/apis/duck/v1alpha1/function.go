@@ -25,7 +25,45 @@ import (
 )
 
 const (
+	// ConfigMapAnnotation is the annotation of the revision template of a
+	// Knative service recording the version of the configuration it serves,
+	// a hash of the configurations of the function instances.
 	ConfigMapAnnotation = "functions.knative.dev/configmap-version"
+
+	// ServiceCountAnnotation is the annotation of the first Knative service
+	// of a function kind recording the number of services serving the
+	// instances of that kind.
+	ServiceCountAnnotation = "functions.knative.dev/services"
+
+	// IsolationAnnotation selects how a function instance is isolated from
+	// the other instances of its kind.
+	IsolationAnnotation = "functions.knative.dev/isolation"
+
+	// DedicatedIsolation is the IsolationAnnotation value requesting a
+	// Knative service serving only the function instance.
+	DedicatedIsolation = "dedicated"
+
+	// ReloadAnnotation selects how the runtime of a function kind loads
+	// configuration changes. It is set on function CRDs and copied to their
+	// Knative services.
+	ReloadAnnotation = "functions.knative.dev/config-reload"
+
+	// RevisionReload is the ReloadAnnotation value rolling out a new
+	// revision of the runtime on configuration changes. It is the default.
+	RevisionReload = "revision"
+
+	// HotReload is the ReloadAnnotation value letting the runtime reload
+	// the configuration files when they change, without a new revision.
+	HotReload = "hot"
+
+	// UnmanagedAnnotation, set to "true" on the route or the dedicated
+	// Knative service of a function instance, stops the controller from
+	// reverting the changes made to it.
+	UnmanagedAnnotation = "functions.knative.dev/unmanaged"
+
+	// FunctionFinalizer is the finalizer added to functions to clean up the
+	// shared runtime upon deletion.
+	FunctionFinalizer = "functions.knative.dev"
 )
 
 // +genclient
@@ -51,6 +89,22 @@ type FunctionStatus struct {
 	// It generally has the form http[s]://{route-name}.{route-namespace}.{cluster-level-suffix}
 	// +optional
 	URL *apis.URL `json:"url,omitempty"`
+
+	// Revision is the name of the runtime revision serving the configuration
+	// of the function.
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// ConfigVersion is the version of the runtime configuration served by
+	// Revision, including the configuration of the function.
+	// +optional
+	ConfigVersion string `json:"configVersion,omitempty"`
+
+	// InstanceConfigVersion is the version of the configuration of the
+	// function served by Revision. Later revisions serve it as well until
+	// it changes.
+	// +optional
+	InstanceConfigVersion string `json:"instanceConfigVersion,omitempty"`
 }
 
 // Ensure Resource satisfies apis.Listable
@@ -24,13 +24,18 @@ import (
 
 // GetGroupVersionKind implements kmeta.OwnerRefable
 func (fn *Function) GetGroupVersionKind() schema.GroupVersionKind {
-	return SchemeGroupVersion.WithKind(fn.Kind)
+	return schema.FromAPIVersionAndKind(fn.APIVersion, fn.Kind)
 }
 
 const (
 	// FunctionConditionReady has status True when all subconditions below have been set to True.
 	FunctionConditionReady = apis.ConditionReady
 
+	// FunctionConditionServiceReady has status true when the Knative service
+	// running the function exists, is ready and is in sync with the
+	// function configuration
+	FunctionConditionServiceReady apis.ConditionType = "ServiceReady"
+
 	// FunctionConditionConfigMapSynced has status true when the function
 	// has been synced with the configmap
 	FunctionConditionConfigMapSynced apis.ConditionType = "ConfigMapSynced"
@@ -43,12 +48,70 @@ const (
 	// associated to the function is ready
 	FunctionConditionRouteReady apis.ConditionType = "RouteReady"
 
-	// FunctionConditionServiceSynced has status true when the function
-	// has been synced with the the associated service
-	FunctionConditionServiceSynced apis.ConditionType = "ServiceReady"
+	// FunctionConditionConfigServed has status true when the runtime serves
+	// the configuration of the function
+	FunctionConditionConfigServed apis.ConditionType = "ConfigServed"
+
+	// FunctionConditionServiceSynced is the former name of
+	// FunctionConditionServiceReady. Both name the same condition type so
+	// the conditions of existing functions keep their meaning.
+	//
+	// Deprecated: use FunctionConditionServiceReady.
+	FunctionConditionServiceSynced = FunctionConditionServiceReady
+)
+
+// Reasons of the function conditions which are not True. The Route and
+// Service conditions also report the reasons of the Knative route and
+// service conditions.
+const (
+	// ReasonServiceCheckFailed is the reason of ServiceReady when the
+	// Knative service of the function kind can't be found.
+	ReasonServiceCheckFailed = "CheckExistFailed"
+
+	// ReasonDedicatedServiceFailed is the reason of ServiceReady when the
+	// Knative service dedicated to the function can't be reconciled.
+	ReasonDedicatedServiceFailed = "DedicatedServiceFailed"
+
+	// ReasonUpdateFailed is the reason of ServiceReady and ConfigMapSynced
+	// when the Knative service or the configmap can't be updated.
+	ReasonUpdateFailed = "UpdateFailed"
+
+	// ReasonRouteReconcileFailed is the reason of RouteReady when the
+	// route of the function can't be created.
+	ReasonRouteReconcileFailed = "ReconcileFailed"
+
+	// ReasonRouteMoveFailed is the reason of RouteReady while the route of
+	// the function can't be moved to another Knative service.
+	ReasonRouteMoveFailed = "MoveFailed"
+
+	// ReasonStatusUnknown is the reason of RouteReady and ServiceReady
+	// while the Knative route or service doesn't report its readiness.
+	ReasonStatusUnknown = "Unknown"
+
+	// ReasonConfigPending is the reason of ConfigMapSynced while the
+	// configuration of the function waits to be written with a batch.
+	ReasonConfigPending = "Pending"
+
+	// ReasonVersionFailed is the reason of ConfigServed when the version
+	// of the configuration can't be computed.
+	ReasonVersionFailed = "VersionFailed"
+
+	// ReasonRollingOut is the reason of ConfigServed while the revision
+	// serving the configuration of the function is rolled out.
+	ReasonRollingOut = "RollingOut"
+
+	// ReasonReloading is the reason of ConfigServed while a runtime
+	// reloading the configuration has not loaded the function configuration.
+	ReasonReloading = "Reloading"
 )
 
-var pFunctionCondSet = apis.NewLivingConditionSet(FunctionConditionReady, FunctionConditionConfigMapSynced, FunctionConditionAddressable)
+var pFunctionCondSet = apis.NewLivingConditionSet(
+	FunctionConditionServiceReady,
+	FunctionConditionRouteReady,
+	FunctionConditionConfigMapSynced,
+	FunctionConditionConfigServed,
+	FunctionConditionAddressable,
+)
 
 // GetCondition returns the condition currently associated with the given type, or nil.
 func (ps *FunctionStatus) GetCondition(t apis.ConditionType) *apis.Condition {
@@ -62,9 +125,22 @@ func (ps *FunctionStatus) IsReady() bool {
 
 // InitializeConditions sets relevant unset conditions to Unknown state.
 func (ps *FunctionStatus) InitializeConditions() {
+	ps.upgradeConditions()
 	pFunctionCondSet.Manage(ps).InitializeConditions()
 }
 
+// upgradeConditions upgrades the conditions of functions reconciled by
+// previous versions, where RouteReady and ServiceReady did not contribute
+// to Ready and were reported with the Info severity.
+func (ps *FunctionStatus) upgradeConditions() {
+	for i := range ps.Conditions {
+		c := &ps.Conditions[i]
+		if (c.Type == FunctionConditionRouteReady || c.Type == FunctionConditionServiceReady) && c.Severity == apis.ConditionSeverityInfo {
+			c.Severity = apis.ConditionSeverityError
+		}
+	}
+}
+
 func (ps *FunctionStatus) MarkConfigMapSynced() {
 	pFunctionCondSet.Manage(ps).MarkTrue(FunctionConditionConfigMapSynced)
 }
@@ -73,12 +149,41 @@ func (ps *FunctionStatus) MarkConfigMapNotSynced(reason, messageFormat string, m
 	pFunctionCondSet.Manage(ps).MarkFalse(FunctionConditionConfigMapSynced, reason, messageFormat, messageA...)
 }
 
+// MarkConfigMapPending marks the configuration as waiting to be written.
+func (ps *FunctionStatus) MarkConfigMapPending(reason, messageFormat string, messageA ...interface{}) {
+	pFunctionCondSet.Manage(ps).MarkUnknown(FunctionConditionConfigMapSynced, reason, messageFormat, messageA...)
+}
+
+// MarkConfigServed records that revision serves the configuration version,
+// including the version instanceVersion of the configuration of the function.
+func (ps *FunctionStatus) MarkConfigServed(revision, version, instanceVersion string) {
+	ps.Revision = revision
+	ps.ConfigVersion = version
+	ps.InstanceConfigVersion = instanceVersion
+	pFunctionCondSet.Manage(ps).MarkTrue(FunctionConditionConfigServed)
+}
+
+// MarkConfigNotServed marks the configuration as not served yet.
+func (ps *FunctionStatus) MarkConfigNotServed(reason, messageFormat string, messageA ...interface{}) {
+	pFunctionCondSet.Manage(ps).MarkUnknown(FunctionConditionConfigServed, reason, messageFormat, messageA...)
+}
+
+func (ps *FunctionStatus) MarkServiceReady() {
+	pFunctionCondSet.Manage(ps).MarkTrue(FunctionConditionServiceReady)
+}
+
+func (ps *FunctionStatus) MarkServiceNotReady(reason, messageFormat string, messageA ...interface{}) {
+	pFunctionCondSet.Manage(ps).MarkFalse(FunctionConditionServiceReady, reason, messageFormat, messageA...)
+}
+
+// Deprecated: use MarkServiceReady.
 func (ps *FunctionStatus) MarkServiceSynced() {
-	pFunctionCondSet.Manage(ps).MarkTrue(FunctionConditionServiceSynced)
+	ps.MarkServiceReady()
 }
 
+// Deprecated: use MarkServiceNotReady.
 func (ps *FunctionStatus) MarkServiceNotSynced(reason, messageFormat string, messageA ...interface{}) {
-	pFunctionCondSet.Manage(ps).MarkFalse(FunctionConditionServiceSynced, reason, messageFormat, messageA...)
+	ps.MarkServiceNotReady(reason, messageFormat, messageA...)
 }
 
 func (ps *FunctionStatus) MarkRouteReady() {
@@ -92,6 +92,17 @@ func (f *dynamicSharedInformerFactory) Start(stopCh <-chan struct{}) {
 	}
 }
 
+// Forget removes the informer for the given resource from the factory. The
+// caller is responsible for stopping the informer. A subsequent call to
+// ForResource returns a fresh informer.
+func (f *dynamicSharedInformerFactory) Forget(gvr schema.GroupVersionResource) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.informers, gvr)
+	delete(f.startedInformers, gvr)
+}
+
 // WaitForCacheSync waits for all started informers' cache were synced.
 func (f *dynamicSharedInformerFactory) WaitForCacheSync(stopCh <-chan struct{}) map[schema.GroupVersionResource]bool {
 	informers := func() map[schema.GroupVersionResource]cache.SharedIndexInformer {
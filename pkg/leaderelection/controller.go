@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/logging"
+)
+
+// NewController wraps ctor so that its reconciler only runs while this
+// replica is the leader. Informers are started on all replicas and keys are
+// queued as usual, so a standby taking over starts reconciling with warm
+// caches.
+//
+// Controllers created with the context passed to ctor can be gated on the
+// same election with Gate.
+func NewController(config Config, ctor injection.ControllerConstructor) injection.ControllerConstructor {
+	return func(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
+		logger := logging.FromContext(ctx)
+
+		elector, err := New(kubeclient.Get(ctx).CoordinationV1(), config, logger.Named("leaderelection"))
+		if err != nil {
+			logger.Fatalw("Invalid leader election configuration", zap.Error(err))
+		}
+		ctx = context.WithValue(ctx, electorKey{}, elector)
+
+		impl := ctor(ctx, cmw)
+		impl.Reconciler = Gate(ctx, impl.Reconciler)
+
+		go elector.Run(ctx)
+
+		return impl
+	}
+}
+
+// electorKey is the context key of the Elector.
+type electorKey struct{}
+
+// Gate wraps r so that it only runs while this replica is the leader, when
+// ctx was created by a controller constructor passed to NewController. It
+// returns r otherwise.
+func Gate(ctx context.Context, r controller.Reconciler) controller.Reconciler {
+	elector, ok := ctx.Value(electorKey{}).(*Elector)
+	if !ok {
+		return r
+	}
+	return &reconciler{
+		ctx:        ctx,
+		elector:    elector,
+		Reconciler: r,
+	}
+}
+
+// reconciler holds the keys while this replica is not the leader.
+type reconciler struct {
+	// ctx is the controller context. The context passed to Reconcile is
+	// never cancelled.
+	ctx     context.Context
+	elector *Elector
+	controller.Reconciler
+}
+
+// Reconcile implements controller.Reconciler
+func (r *reconciler) Reconcile(ctx context.Context, key string) error {
+	select {
+	case <-r.elector.Leading():
+		return r.Reconciler.Reconcile(ctx, key)
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
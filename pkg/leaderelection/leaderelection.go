@@ -0,0 +1,159 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package leaderelection elects a single leader among the controller
+// replicas using a coordination Lease.
+package leaderelection
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// DefaultLeaseDuration is how long standbys wait before taking over a
+	// lease that has not been renewed.
+	DefaultLeaseDuration = 15 * time.Second
+
+	// DefaultRenewDeadline is how long the leader keeps retrying to renew
+	// its lease before giving up leadership.
+	DefaultRenewDeadline = 10 * time.Second
+
+	// DefaultRetryPeriod is how long to wait between two attempts to
+	// acquire or renew the lease.
+	DefaultRetryPeriod = 2 * time.Second
+)
+
+// Config configures the leader election.
+type Config struct {
+	// LeaseName is the name of the lease shared by all replicas.
+	LeaseName string
+
+	// Namespace is the namespace of the lease.
+	Namespace string
+
+	// Identity uniquely identifies this replica.
+	Identity string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// Elector runs the leader election on behalf of this replica.
+type Elector struct {
+	elector *leaderelection.LeaderElector
+	logger  *zap.SugaredLogger
+
+	lock sync.Mutex
+	// leading is closed while this replica is the leader.
+	leading chan struct{}
+}
+
+// New creates an Elector. Zero durations are replaced by their default.
+func New(client coordinationv1client.LeasesGetter, config Config, logger *zap.SugaredLogger) (*Elector, error) {
+	if config.LeaseDuration == 0 {
+		config.LeaseDuration = DefaultLeaseDuration
+	}
+	if config.RenewDeadline == 0 {
+		config.RenewDeadline = DefaultRenewDeadline
+	}
+	if config.RetryPeriod == 0 {
+		config.RetryPeriod = DefaultRetryPeriod
+	}
+
+	e := &Elector{
+		logger:  logger.With(zap.String("lease", config.Namespace+"/"+config.LeaseName), zap.String("identity", config.Identity)),
+		leading: make(chan struct{}),
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      config.LeaseName,
+				Namespace: config.Namespace,
+			},
+			Client:     client,
+			LockConfig: resourcelock.ResourceLockConfig{Identity: config.Identity},
+		},
+		LeaseDuration: config.LeaseDuration,
+		RenewDeadline: config.RenewDeadline,
+		RetryPeriod:   config.RetryPeriod,
+		// The lease is released on shutdown so that a standby takes over
+		// without waiting for it to expire.
+		ReleaseOnCancel: true,
+		Name:            config.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.startLeading,
+			OnStoppedLeading: e.stopLeading,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.elector = elector
+	return e, nil
+}
+
+// Leading returns a channel closed while this replica is the leader.
+func (e *Elector) Leading() <-chan struct{} {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.leading
+}
+
+// Run takes part in the election until ctx is done. When the lease cannot be
+// renewed in time, this replica stops leading and runs for the lease again.
+func (e *Elector) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		e.logger.Info("Waiting for leadership")
+		e.elector.Run(ctx)
+	}
+}
+
+// startLeading is called asynchronously with a context done when the
+// leadership is lost.
+func (e *Elector) startLeading(ctx context.Context) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// stopLeading may have been called already.
+	if ctx.Err() != nil {
+		return
+	}
+	e.logger.Info("Acquired leadership")
+	close(e.leading)
+}
+
+func (e *Elector) stopLeading() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	select {
+	case <-e.leading:
+		e.logger.Info("Lost leadership")
+		e.leading = make(chan struct{})
+	default:
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/system"
+)
+
+const (
+	// ConfigName is the name of the configmap holding the controller configuration.
+	ConfigName = "config-functions"
+
+	// RuntimeNamespaceKey is the configmap key holding the namespace
+	// where the function runtimes (services, routes and configmaps) are created.
+	RuntimeNamespaceKey = "runtime-namespace"
+
+	// ConfigBatchWindowKey is the configmap key holding the duration during
+	// which the configuration changes of the instances of a function kind
+	// are coalesced before being written.
+	ConfigBatchWindowKey = "config-batch-window"
+
+	// DefaultConfigBatchWindow is the default configuration batch window.
+	DefaultConfigBatchWindow = 2 * time.Second
+)
+
+// Config holds the controller configuration.
+type Config struct {
+	// RuntimeNamespace is the namespace where the function runtimes are created.
+	RuntimeNamespace string
+
+	// ConfigBatchWindow is the duration during which configuration changes
+	// are coalesced. Changes are written immediately when it is 0.
+	ConfigBatchWindow time.Duration
+}
+
+// NewConfigFromMap creates a Config from the supplied map.
+func NewConfigFromMap(data map[string]string) (*Config, error) {
+	config := &Config{
+		RuntimeNamespace:  system.Namespace(),
+		ConfigBatchWindow: DefaultConfigBatchWindow,
+	}
+
+	if ns, ok := data[RuntimeNamespaceKey]; ok && ns != "" {
+		config.RuntimeNamespace = ns
+	}
+
+	if raw, ok := data[ConfigBatchWindowKey]; ok && raw != "" {
+		window, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", ConfigBatchWindowKey, err)
+		}
+		if window < 0 {
+			return nil, fmt.Errorf("%s must not be negative, was %v", ConfigBatchWindowKey, window)
+		}
+		config.ConfigBatchWindow = window
+	}
+
+	return config, nil
+}
+
+// NewConfigFromConfigMap creates a Config from the supplied configmap.
+func NewConfigFromConfigMap(cm *corev1.ConfigMap) (*Config, error) {
+	return NewConfigFromMap(cm.Data)
+}
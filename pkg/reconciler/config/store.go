@@ -0,0 +1,103 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/system"
+)
+
+type cfgKey struct{}
+
+type storeKey struct{}
+
+// FromContext extracts the controller configuration from the context.
+func FromContext(ctx context.Context) *Config {
+	return ctx.Value(cfgKey{}).(*Config)
+}
+
+// ToContext attaches the controller configuration to the context.
+func ToContext(ctx context.Context, c *Config) context.Context {
+	return context.WithValue(ctx, cfgKey{}, c)
+}
+
+// WithStore attaches the store to the context, so that controllers created
+// after the configmap watcher has started can share it.
+func WithStore(ctx context.Context, s *Store) context.Context {
+	return context.WithValue(ctx, storeKey{}, s)
+}
+
+// GetStore extracts the store from the context.
+func GetStore(ctx context.Context) *Store {
+	untyped := ctx.Value(storeKey{})
+	if untyped == nil {
+		logging.FromContext(ctx).Panicf(
+			"Unable to fetch %T from context.", (*Store)(nil))
+	}
+	return untyped.(*Store)
+}
+
+// Store is a typed wrapper around configmap.UntypedStore to handle the
+// controller configuration.
+type Store struct {
+	*configmap.UntypedStore
+}
+
+// NewStore creates a new store of the controller configuration.
+func NewStore(logger configmap.Logger, onAfterStore ...func(name string, value interface{})) *Store {
+	return &Store{
+		UntypedStore: configmap.NewUntypedStore(
+			"functions",
+			logger,
+			configmap.Constructors{
+				ConfigName: NewConfigFromConfigMap,
+			},
+			onAfterStore...,
+		),
+	}
+}
+
+// WatchConfigs watches the controller configmap, falling back to the
+// default configuration when the watcher supports it and the configmap
+// does not exist.
+func (s *Store) WatchConfigs(w configmap.Watcher) {
+	if dw, ok := w.(configmap.DefaultingWatcher); ok {
+		dw.WatchWithDefault(corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ConfigName,
+				Namespace: system.Namespace(),
+			},
+		}, s.OnConfigChanged)
+		return
+	}
+	s.UntypedStore.WatchConfigs(w)
+}
+
+// ToContext attaches the current controller configuration to the context.
+func (s *Store) ToContext(ctx context.Context) context.Context {
+	return ToContext(ctx, s.Load())
+}
+
+// Load returns the current controller configuration.
+func (s *Store) Load() *Config {
+	return s.UntypedLoad(ConfigName).(*Config)
+}
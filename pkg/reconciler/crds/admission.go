@@ -0,0 +1,306 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"go.uber.org/zap"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	admissionlisters "k8s.io/client-go/listers/admissionregistration/v1beta1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	vwhinformer "knative.dev/pkg/client/injection/kube/informers/admissionregistration/v1beta1/validatingwebhookconfiguration"
+	secretinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/secret"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	"knative.dev/pkg/kmp"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/ptr"
+	"knative.dev/pkg/system"
+	"knative.dev/pkg/webhook"
+	certresources "knative.dev/pkg/webhook/certificates/resources"
+
+	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+	pkgdynamic "github.com/lionelvillard/knative-functions-controller/pkg/dynamic"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/events"
+)
+
+const (
+	// AdmissionWebhookName is the name of the ValidatingWebhookConfiguration,
+	// and of its webhook, denying the deletion of function CRDs while
+	// instances remain.
+	AdmissionWebhookName = "crd-deletion.functions.knative.dev"
+
+	// admissionPath is the path the webhook is served on.
+	admissionPath = "/crd-deletion"
+
+	// remainingInstancesAnnotation reports the number of function instances
+	// blocking the deletion of a function CRD.
+	remainingInstancesAnnotation = "functions.knative.dev/remaining-instances"
+)
+
+// NewAdmissionController returns a controller registering the certificate
+// authority of the webhook denying the deletion of function CRDs while
+// instances remain, and serving the webhook until ctx is done.
+//
+// A finalizer can't keep a CRD deletion pending: the API server deletes all
+// instances as soon as the CRD is marked for deletion.
+func NewAdmissionController(crdGVR schema.GroupVersionResource) injection.ControllerConstructor {
+	return func(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
+		logger := logging.FromContext(ctx)
+
+		vwhInformer := vwhinformer.Get(ctx)
+		secretInformer := secretinformer.Get(ctx)
+		options := webhook.GetOptions(ctx)
+
+		r := &admissionReconciler{
+			kubeClient:   kubeclient.Get(ctx),
+			vwhLister:    vwhInformer.Lister(),
+			secretLister: secretInformer.Lister(),
+			secretName:   options.SecretName,
+		}
+		impl := controller.NewImpl(r, logger, "CRDDeletionWebhook")
+
+		logger.Info("Setting up event handlers")
+
+		// It doesn't matter what we enqueue: the webhook configuration is
+		// always reconciled.
+		vwhInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: controller.FilterWithName(AdmissionWebhookName),
+			Handler:    controller.HandleAll(impl.Enqueue),
+		})
+		secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: controller.FilterWithNameAndNamespace(system.Namespace(), r.secretName),
+			Handler:    controller.HandleAll(impl.Enqueue),
+		})
+
+		validator := &deletionValidator{
+			dynamicClient: dynamicclient.Get(ctx),
+			crdClient:     dynamicclient.Get(ctx).Resource(crdGVR),
+			crdLister:     pkgdynamic.Get(ctx, crdGVR).Lister(),
+			crdGVR:        crdGVR,
+			Recorder:      events.NewRecorder(ctx, kubeclient.Get(ctx), controllerAgentName),
+		}
+
+		// The webhook is served here rather than by sharedmain, which stops
+		// the process when the webhook fails.
+		webhook.RegisterMetrics()
+		wh, err := webhook.New(ctx, []webhook.AdmissionController{validator})
+		if err != nil {
+			logger.Errorw("Failed to create the admission webhook", zap.Error(err))
+			return impl
+		}
+		go func() {
+			if err := wh.Run(ctx.Done()); err != nil {
+				logger.Errorw("Failed to serve the admission webhook", zap.Error(err))
+			}
+		}()
+
+		return impl
+	}
+}
+
+// admissionReconciler registers the certificate authority of the webhook
+// in its ValidatingWebhookConfiguration.
+type admissionReconciler struct {
+	kubeClient   kubernetes.Interface
+	vwhLister    admissionlisters.ValidatingWebhookConfigurationLister
+	secretLister corev1listers.SecretLister
+
+	// secretName is the name of the secret holding the webhook certificates.
+	secretName string
+}
+
+// Check that our Reconciler implements controller.Reconciler
+var _ controller.Reconciler = (*admissionReconciler)(nil)
+
+// Reconcile implements controller.Reconciler
+func (r *admissionReconciler) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	secret, err := r.secretLister.Secrets(system.Namespace()).Get(r.secretName)
+	if err != nil {
+		logger.Error("Unable to get the webhook certificates", zap.Error(err))
+		return err
+	}
+	caCert, ok := secret.Data[certresources.CACert]
+	if !ok {
+		return fmt.Errorf("secret %q is missing %q key", r.secretName, certresources.CACert)
+	}
+
+	configured, err := r.vwhLister.Get(AdmissionWebhookName)
+	if err != nil {
+		logger.Error("Unable to get the webhook configuration", zap.Error(err))
+		return err
+	}
+
+	desired := configured.DeepCopy()
+	for i, wh := range desired.Webhooks {
+		if wh.Name != AdmissionWebhookName {
+			continue
+		}
+		if wh.ClientConfig.Service == nil {
+			return fmt.Errorf("missing service reference for webhook: %s", wh.Name)
+		}
+		desired.Webhooks[i].ClientConfig.CABundle = caCert
+		desired.Webhooks[i].ClientConfig.Service.Path = ptr.String(admissionPath)
+	}
+
+	if ok, err := kmp.SafeEqual(configured, desired); err != nil {
+		return fmt.Errorf("error diffing webhooks: %v", err)
+	} else if ok {
+		return nil
+	}
+
+	logger.Info("Updating the webhook configuration")
+	_, err = r.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Update(desired)
+	return err
+}
+
+// deletionValidator denies the deletion of function CRDs while instances
+// remain, unless forceDeleteAnnotation is set.
+type deletionValidator struct {
+	dynamicClient dynamic.Interface
+	crdClient     dynamic.NamespaceableResourceInterface
+	crdLister     cache.GenericLister
+	crdGVR        schema.GroupVersionResource
+
+	// Recorder is an event recorder for recording Event resources to the
+	// Kubernetes API.
+	Recorder record.EventRecorder
+}
+
+// Check that our validator implements webhook.AdmissionController
+var _ webhook.AdmissionController = (*deletionValidator)(nil)
+
+// Path implements webhook.AdmissionController
+func (v *deletionValidator) Path() string {
+	return admissionPath
+}
+
+// Admit implements webhook.AdmissionController
+func (v *deletionValidator) Admit(ctx context.Context, req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if err := v.validate(ctx, req); err != nil {
+		status := apierrs.NewForbidden(v.crdGVR.GroupResource(), req.Name, err).Status()
+		return &admissionv1beta1.AdmissionResponse{
+			Allowed: false,
+			Result:  &status,
+		}
+	}
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+// validate returns an error when req deletes a function CRD whose instances
+// remain. The number of remaining instances is reported on the CRD, unless
+// req is a dry run.
+func (v *deletionValidator) validate(ctx context.Context, req *admissionv1beta1.AdmissionRequest) error {
+	logger := logging.FromContext(ctx)
+
+	if req.Operation != admissionv1beta1.Delete || req.Resource.Group != v.crdGVR.Group || req.Resource.Resource != v.crdGVR.Resource {
+		return nil
+	}
+
+	crd, err := getCRD(v.crdLister, req.Name)
+	if apierrs.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !isFunctionCRD(crd) || crd.Annotations[forceDeleteAnnotation] == "true" {
+		return nil
+	}
+	gvr := crd.FunctionResource()
+	if gvr.Version == "" {
+		return nil
+	}
+
+	count, err := remainingInstances(v.dynamicClient, gvr)
+	if err != nil {
+		logger.Error("Unable to list function instances", zap.Error(err))
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	if req.DryRun == nil || !*req.DryRun {
+		v.reportRemaining(ctx, crd, count)
+	}
+	return fmt.Errorf("%d function instances of %q remain. Delete them or set the %s annotation to \"true\" to force the removal",
+		count, crd.Name, forceDeleteAnnotation)
+}
+
+// reportRemaining records the count of instances blocking the deletion of
+// crd in remainingInstancesAnnotation and as an event.
+func (v *deletionValidator) reportRemaining(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition, count int) {
+	v.Recorder.Eventf(crd, corev1.EventTypeWarning, "DeletionBlocked",
+		"%d function instances remain. Delete them or set the %s annotation to \"true\" to force the removal",
+		count, forceDeleteAnnotation)
+
+	if crd.Annotations[remainingInstancesAnnotation] == strconv.Itoa(count) {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				remainingInstancesAnnotation: strconv.Itoa(count),
+			},
+		},
+	})
+	if err == nil {
+		_, err = v.crdClient.Patch(crd.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to update the remaining instances annotation", zap.Error(err))
+	}
+}
+
+// remainingInstances returns the number of instances of the function
+// resource gvr which are not being deleted.
+func remainingInstances(client dynamic.Interface, gvr schema.GroupVersionResource) (int, error) {
+	list, err := client.Resource(gvr).Namespace(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	count := 0
+	for _, item := range list.Items {
+		if item.GetDeletionTimestamp() == nil {
+			count++
+		}
+	}
+	return count, nil
+}
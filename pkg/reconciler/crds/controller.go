@@ -18,64 +18,210 @@ package crds
 
 import (
 	"context"
+	"errors"
 
-	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/record"
-	apiextensionsclient "knative.dev/pkg/client/injection/apiextensions/client"
-	crdinformers "knative.dev/pkg/client/injection/apiextensions/informers/apiextensions/v1beta1/customresourcedefinition"
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	configmapinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/configmap"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
 	servingclient "knative.dev/serving/pkg/client/injection/client"
+	routeinformer "knative.dev/serving/pkg/client/injection/informers/serving/v1beta1/route"
 	serviceinformer "knative.dev/serving/pkg/client/injection/informers/serving/v1beta1/service"
+
+	"github.com/lionelvillard/knative-functions-controller/pkg/dynamic"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/config"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/events"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/functions"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/manager"
 )
 
 const (
 	controllerAgentName = "crd-controller"
+
+	// functionCRDLabel marks the CRDs defining a function kind
+	functionCRDLabel = "functions.knative.dev/crd"
+
+	// crdNameLabel records the name of the function CRD on the Knative
+	// services and configmaps shared by its instances.
+	crdNameLabel = "functions.knative.dev/crd-name"
+
+	// finalizerName is the finalizer added to function CRDs to tear down
+	// the runtime resources shared by the function instances.
+	finalizerName = "functions.knative.dev"
+
+	// legacyProtectionFinalizerName is the finalizer previous versions added
+	// to keep function CRDs from being deleted while function instances
+	// remain. It is removed when the CRD is finalized.
+	legacyProtectionFinalizerName = "functions.knative.dev/protection"
+
+	// forceDeleteAnnotation opts out of the deletion protection when set to "true".
+	forceDeleteAnnotation = "functions.knative.dev/force-delete"
+
+	// runtimeNamespaceAnnotation records the namespace where the runtime
+	// resources of a function CRD have been created.
+	runtimeNamespaceAnnotation = "functions.knative.dev/runtime-namespace"
+
+	// legacyRuntimeNamespace is where services and routes were created
+	// before the runtime namespace was configurable.
+	legacyRuntimeNamespace = "knative-functions"
+
+	// maxInstancesPerServiceAnnotation sets the maximum number of instances
+	// served by each Knative service of a function CRD. Instances are served
+	// by a single service when not set.
+	maxInstancesPerServiceAnnotation = "functions.knative.dev/max-instances-per-service"
+
+	// maxServices is the maximum number of Knative services of a function CRD.
+	maxServices = 64
 )
 
-// NewController returns a new CRD reconcile controller.
-func NewController(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
-	logger := logging.FromContext(ctx)
-
-	crdInformer := crdinformers.Get(ctx)
-	serviceInformer := serviceinformer.Get(ctx)
-
-	r := &Reconciler{
-		kubeClient:    kubeclient.Get(ctx),
-		crdClient:     apiextensionsclient.Get(ctx),
-		crdLister:     crdInformer.Lister(),
-		servingClient: servingclient.Get(ctx),
-		serviceLister: serviceInformer.Lister(),
-		Recorder: record.NewBroadcaster().NewRecorder(
-			scheme.Scheme, corev1.EventSource{Component: controllerAgentName}),
+// CRDResource returns the CustomResourceDefinition resource served by the
+// API server, preferring apiextensions.k8s.io/v1 over apiextensions.k8s.io/v1beta1.
+func CRDResource(client discovery.DiscoveryInterface) (schema.GroupVersionResource, error) {
+	for _, version := range []string{"v1", "v1beta1"} {
+		_, err := client.ServerResourcesForGroupVersion("apiextensions.k8s.io/" + version)
+		if err == nil {
+			return schema.GroupVersionResource{
+				Group:    "apiextensions.k8s.io",
+				Version:  version,
+				Resource: "customresourcedefinitions",
+			}, nil
+		}
+		if !apierrs.IsNotFound(err) {
+			return schema.GroupVersionResource{}, err
+		}
 	}
-	impl := controller.NewImpl(r, logger, "crd")
-
-	logger.Info("Setting up event handlers")
-
-	crdInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
-		FilterFunc: func(obj interface{}) bool {
-			if object, ok := obj.(metav1.Object); ok {
-				if labels := object.GetLabels(); labels != nil {
-					if v, ok := labels["functions.knative.dev/crd"]; ok && v == "true" {
-						// for _, name := range names {
-						// 	if name == object.GetName() {
-						// 		return false
-						// 	}
-						// }
-						return true
-					}
+	return schema.GroupVersionResource{}, errors.New("the CustomResourceDefinition API is not served")
+}
+
+// NewController returns a new CRD reconcile controller watching the given
+// CustomResourceDefinition resource.
+func NewController(crdGVR schema.GroupVersionResource) injection.ControllerConstructor {
+	return func(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
+		logger := logging.FromContext(ctx)
+
+		crdInformer := dynamic.Get(ctx, crdGVR)
+		serviceInformer := serviceinformer.Get(ctx)
+		routeInformer := routeinformer.Get(ctx)
+		configMapInformer := configmapinformer.Get(ctx)
+
+		r := &Reconciler{
+			kubeClient:      kubeclient.Get(ctx),
+			crdClient:       dynamicclient.Get(ctx).Resource(crdGVR),
+			crdLister:       crdInformer.Lister(),
+			dynamicClient:   dynamicclient.Get(ctx),
+			servingClient:   servingclient.Get(ctx),
+			serviceLister:   serviceInformer.Lister(),
+			routeLister:     routeInformer.Lister(),
+			configMapLister: configMapInformer.Lister(),
+			Recorder:        events.NewRecorder(ctx, kubeclient.Get(ctx), controllerAgentName),
+		}
+		impl := controller.NewImpl(r, logger, "crd")
+
+		logger.Info("Setting up ConfigMap receivers")
+		r.configStore = config.NewStore(logger.Named("config-store"), func(string, interface{}) {
+			impl.GlobalResync(crdInformer.Informer())
+			r.functions.Resync()
+		})
+		r.configStore.WatchConfigs(cmw)
+
+		// Function controllers are created after the configmap watcher has
+		// started so they share the store created above.
+		r.functions = manager.New(config.WithStore(ctx, r.configStore), cmw, functions.NewController,
+			// Adjust the number of services as instances come and go.
+			func(name string) {
+				impl.EnqueueKey(types.NamespacedName{Name: name})
+			})
+
+		logger.Info("Setting up event handlers")
+
+		crdInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: func(obj interface{}) bool {
+				// Keep watching CRDs no longer labelled until they are finalized.
+				if object, ok := obj.(metav1.Object); ok && (hasFinalizer(object, finalizerName) || hasFinalizer(object, legacyProtectionFinalizerName)) {
+					return true
 				}
-			}
-			return false
-		},
-		Handler: controller.HandleAll(impl.Enqueue),
-	})
+				return isFunctionCRD(obj)
+			},
+			Handler: controller.HandleAll(impl.Enqueue),
+		})
 
-	return impl
+		// Start the function informers on all replicas, so that a standby
+		// taking over does not list all function instances from scratch.
+		// The function controllers are only started by the leader.
+		crdInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: isFunctionCRD,
+			Handler: cache.ResourceEventHandlerFuncs{
+				AddFunc:    r.watchFunctions,
+				UpdateFunc: func(_, obj interface{}) { r.watchFunctions(obj) },
+				DeleteFunc: r.unwatchFunctions,
+			},
+		})
+
+		// Repair the services and configmaps changed or deleted behind our back.
+		serviceInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: hasCRDName,
+			Handler:    controller.HandleAll(impl.EnqueueLabelOfClusterScopedResource(crdNameLabel)),
+		})
+		configMapInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: hasCRDName,
+			Handler:    controller.HandleAll(impl.EnqueueLabelOfClusterScopedResource(crdNameLabel)),
+		})
+
+		return impl
+	}
+}
+
+// watchFunctions starts the informer of the instances of the function CRD
+// obj. Informers of CRDs being deleted are stopped by the reconciler.
+func (r *Reconciler) watchFunctions(obj interface{}) {
+	untyped, ok := obj.(*unstructured.Unstructured)
+	if !ok || untyped.GetDeletionTimestamp() != nil {
+		return
+	}
+	crd, err := toCRD(untyped)
+	if err != nil {
+		return
+	}
+	if gvr := crd.FunctionResource(); gvr.Version != "" {
+		r.functions.Watch(crd.Name, gvr)
+	}
+}
+
+// unwatchFunctions stops the informer of the instances of the function CRD
+// obj, which is deleted or no longer labelled as a function CRD.
+func (r *Reconciler) unwatchFunctions(obj interface{}) {
+	if object, err := kmeta.DeletionHandlingAccessor(obj); err == nil {
+		r.functions.Stop(object.GetName())
+	}
+}
+
+// hasCRDName returns true when obj is labelled with the name of a function CRD.
+func hasCRDName(obj interface{}) bool {
+	if object, ok := obj.(metav1.Object); ok {
+		return object.GetLabels()[crdNameLabel] != ""
+	}
+	return false
+}
+
+// isFunctionCRD returns true when obj is labelled as a function CRD.
+func isFunctionCRD(obj interface{}) bool {
+	if object, ok := obj.(metav1.Object); ok {
+		if labels := object.GetLabels(); labels != nil {
+			if v, ok := labels[functionCRDLabel]; ok && v == "true" {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -18,20 +18,25 @@ package crds
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
-	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
-
-	apiextclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
-	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1beta1"
-	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/apis/duck"
 	"knative.dev/pkg/controller"
 	"knative.dev/pkg/logging"
 	"knative.dev/pkg/system"
@@ -39,7 +44,13 @@ import (
 	servingclient "knative.dev/serving/pkg/client/clientset/versioned"
 	servingv1beta1listers "knative.dev/serving/pkg/client/listers/serving/v1beta1"
 
+	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/config"
 	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/crds/resources"
+	fnresources "github.com/lionelvillard/knative-functions-controller/pkg/reconciler/functions/resources"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/manager"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/shards"
 )
 
 // Reconciler implements controller.Reconciler for dynamic resources.
@@ -47,17 +58,32 @@ type Reconciler struct {
 	// KubeClient allows us to talk to the k8s for core APIs
 	kubeClient kubernetes.Interface
 
-	//
-	crdClient apiextclientset.Interface
+	// crdClient allows us to talk to the CRDs
+	crdClient dynamic.NamespaceableResourceInterface
+
+	// DynamicClient allows us to talk to the Functions
+	dynamicClient dynamic.Interface
 
 	// servingClient allows us to talk to the serving APIs
 	servingClient servingclient.Interface
 
+	// routeLister index properties about Knative routes
+	routeLister servingv1beta1listers.RouteLister
+
 	// serviceLister index properties about Knative services
 	serviceLister servingv1beta1listers.ServiceLister
 
+	// configMapLister index properties about configmaps
+	configMapLister corev1listers.ConfigMapLister
+
 	// crdLister index properties about CRDs
-	crdLister apiextensionsv1beta1.CustomResourceDefinitionLister
+	crdLister cache.GenericLister
+
+	// functions starts and stops the controllers reconciling function instances
+	functions *manager.Manager
+
+	// configStore holds the controller configuration
+	configStore *config.Store
 
 	// Recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
@@ -70,11 +96,13 @@ var _ controller.Reconciler = (*Reconciler)(nil)
 // Reconcile implements controller.Reconciler
 func (r *Reconciler) Reconcile(ctx context.Context, name string) error {
 	logger := logging.FromContext(ctx)
+	ctx = r.configStore.ToContext(ctx)
 
-	crd, err := r.crdLister.Get(name)
+	crd, err := getCRD(r.crdLister, name)
 	if apierrs.IsNotFound(err) {
 		// The resource may no longer exist, in which case we stop processing.
 		logger.Errorf("resource %q no longer exists", name)
+		r.functions.Stop(name)
 		return nil
 	} else if err != nil {
 		return err
@@ -83,44 +111,190 @@ func (r *Reconciler) Reconcile(ctx context.Context, name string) error {
 	return r.reconcile(ctx, crd)
 }
 
-func (r *Reconciler) reconcile(ctx context.Context, crd *apiextv1beta1.CustomResourceDefinition) error {
-	if crd.GetDeletionTimestamp() != nil {
+func (r *Reconciler) reconcile(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition) error {
+	if crd.GetDeletionTimestamp() != nil || !isFunctionCRD(crd) {
 		// Check for a DeletionTimestamp.  If present, elide the normal reconcile logic.
-		// When a controller needs finalizer handling, it would go here.
-		return nil
+		// A CRD no longer labelled as a function is handled the same way.
+		r.functions.Stop(crd.Name)
+		return r.finalize(ctx, crd)
 	}
 
-	functionName := crd.Spec.Names.Plural
+	if err := r.addFinalizer(crd); err != nil {
+		return err
+	}
 
-	// Make sure the function service/configmaps exists
-	cm, err := r.reconcileConfig(ctx, functionName)
+	// Make sure the function instances are being reconciled
+	gvr := crd.FunctionResource()
+	if gvr.Version == "" {
+		r.functions.Stop(crd.Name)
+		return fmt.Errorf("CRD %q does not serve any version", crd.Name)
+	}
+	r.functions.Start(crd.Name, gvr)
+
+	// Make sure the function services/configmaps exists
+	count, err := r.serviceCount(ctx, crd)
 	if err != nil {
 		return err
 	}
 
-	_, err = r.reconcileService(ctx, functionName, cm)
-	if err != nil {
+	// The first service records the number of services. Reconcile it last
+	// so that instances are only assigned to existing services.
+	for index := count - 1; index >= 0; index-- {
+		serviceName := names.ServiceShardName(functionGroupResource(crd), index)
+		cms, err := r.reconcileConfig(ctx, crd, serviceName)
+		if err != nil {
+			return err
+		}
+
+		_, err = r.reconcileService(ctx, crd, index, count, cms)
+		if err != nil {
+			return err
+		}
+	}
 
+	if err := r.deleteUnusedServices(ctx, crd, count); err != nil {
 		return err
 	}
 
-	return nil
+	return r.reconcileRuntimeNamespace(ctx, crd)
 }
 
-func (r *Reconciler) reconcileConfig(ctx context.Context, functionName string) (*corev1.ConfigMap, error) {
+// serviceCount returns the number of Knative services serving the instances
+// of the CRD. Instances are spread across several services when the CRD
+// sets a maximum number of instances per service.
+func (r *Reconciler) serviceCount(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition) (int, error) {
+	threshold, err := strconv.Atoi(crd.Annotations[maxInstancesPerServiceAnnotation])
+	if err != nil || threshold < 1 {
+		return 1, nil
+	}
+
+	current := 1
+	ns := config.FromContext(ctx).RuntimeNamespace
+	service, err := r.serviceLister.Services(ns).Get(names.ServiceName(functionGroupResource(crd)))
+	if err == nil {
+		current = fnresources.ServiceCount(service)
+	} else if !apierrs.IsNotFound(err) {
+		logging.FromContext(ctx).Error("Unable to get the function service", zap.Error(err))
+		return 0, err
+	}
+
+	instances, ok := r.functions.Instances(crd.Name)
+	if !ok {
+		return current, nil
+	}
+
+	count := (instances + threshold - 1) / threshold
+	if count < 1 {
+		count = 1
+	}
+	if count > maxServices {
+		count = maxServices
+	}
+
+	// Only remove services when the remaining ones are at most 80% full,
+	// to not add and remove services as instances come and go.
+	if count < current && instances*5 > count*threshold*4 {
+		count = current
+	}
+	return count, nil
+}
+
+// reconcileRuntimeNamespace removes the runtime resources left behind in the
+// previous runtime namespace, if it changed, and records the current one.
+func (r *Reconciler) reconcileRuntimeNamespace(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition) error {
+	ns := config.FromContext(ctx).RuntimeNamespace
+
+	serviceNamespace, configNamespace := runtimeNamespaces(crd)
+	if serviceNamespace != ns || configNamespace != ns {
+		services, err := r.serviceNames(crd, serviceNamespace, 0)
+		if err != nil {
+			return err
+		}
+
+		if serviceNamespace != ns {
+			if err := r.deleteRoutes(ctx, crd, serviceNamespace); err != nil {
+				return err
+			}
+		}
+		for _, service := range services {
+			if serviceNamespace != ns {
+				if err := r.deleteService(ctx, crd, serviceNamespace, service); err != nil {
+					return err
+				}
+			}
+			if configNamespace != ns {
+				if err := r.deleteConfig(ctx, crd, configNamespace, service); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if crd.Annotations[runtimeNamespaceAnnotation] == ns {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				runtimeNamespaceAnnotation: ns,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.patchCRD(crd.Name, patch)
+	return err
+}
+
+// runtimeNamespaces returns the namespaces where the service and the
+// configmap of the function CRD were last created.
+func runtimeNamespaces(crd *duckv1alpha1.CustomResourceDefinition) (string, string) {
+	if ns, ok := crd.Annotations[runtimeNamespaceAnnotation]; ok {
+		return ns, ns
+	}
+	return legacyRuntimeNamespace, system.Namespace()
+}
+
+// reconcileConfig makes sure the configuration shards of the service exist
+// and are labelled with the CRD name, and returns all shards. New shards are
+// stored in the format selected by the CRD. Existing shards are only
+// migrated when the CRD selects a format explicitly.
+func (r *Reconciler) reconcileConfig(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition, service string) ([]*corev1.ConfigMap, error) {
 	logger := logging.FromContext(ctx)
 
-	cmname := fmt.Sprintf("config-function-%s", functionName)
+	selected, explicit := crd.Annotations[shards.FormatAnnotation]
+	format, err := shards.ParseFormat(selected)
+	if err != nil {
+		return nil, err
+	}
+
+	ns := config.FromContext(ctx).RuntimeNamespace
+	cmname := names.ConfigMapName(service)
+	labels := map[string]string{crdNameLabel: crd.Name}
+
+	// Configurations lost with a deleted shard are written back by the
+	// function instances.
+	resync := false
 
-	cm, err := r.kubeClient.CoreV1().ConfigMaps(system.Namespace()).Get(cmname, metav1.GetOptions{})
+	cm, err := r.configMapLister.ConfigMaps(ns).Get(cmname)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
-			cm, err = resources.MakeConfigMap(system.Namespace(), cmname)
+			cm, err = resources.MakeConfigMap(ns, cmname, format)
 			if err != nil {
 				logger.Error("Failed to create the function configmap", zap.Error(err))
 				return nil, err
 			}
-			cm, err = r.kubeClient.CoreV1().ConfigMaps(system.Namespace()).Create(cm)
+			cm.Labels = labels
+			cm, err = r.kubeClient.CoreV1().ConfigMaps(ns).Create(cm)
+			if apierrs.IsAlreadyExists(err) {
+				// The configmap is not in the lister yet.
+				cm, err = r.kubeClient.CoreV1().ConfigMaps(ns).Get(cmname, metav1.GetOptions{})
+			} else if err == nil {
+				r.Recorder.Eventf(crd, corev1.EventTypeNormal, "ConfigMapCreated", "Created function configmap %s/%s", ns, cmname)
+				resync = true
+			}
 			if err != nil {
 				logger.Error("Failed to create the function configmap", zap.Error(err))
 				return nil, err
@@ -131,51 +305,527 @@ func (r *Reconciler) reconcileConfig(ctx context.Context, functionName string) (
 		}
 	}
 
-	return cm, nil
-}
+	client := shards.NewClient(r.kubeClient.CoreV1(), r.configMapLister, ns, service)
 
-func (r *Reconciler) reconcileService(ctx context.Context, functionName string, cm *corev1.ConfigMap) (*servingv1beta1.Service, error) {
-	logger := logging.FromContext(ctx)
+	var cms []*corev1.ConfigMap
+	if explicit && shards.Format(cm) != format {
+		// Configmaps created by previous versions store all configurations
+		// in a single file, read by the existing runtimes.
+		cms, err = client.Migrate(ctx, format)
+		if err != nil {
+			logger.Error("Failed to migrate the function configmaps", zap.Error(err))
+			return nil, err
+		}
+	} else {
+		cms, err = client.Get()
+		if err != nil {
+			logger.Error("Unable to get the function configmap shards", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	for i, cm := range cms {
+		if cm.ResourceVersion == "" {
+			// Missing shards are recreated by the next write.
+			resync = true
+			continue
+		}
+		if hasMetadata(cm, &metav1.ObjectMeta{Labels: labels}) {
+			continue
+		}
+		cms[i], err = r.patchConfigMapLabels(cm, labels)
+		if err != nil {
+			logger.Error("Failed to label the function configmap", zap.String("configmap", cm.Name), zap.Error(err))
+			return nil, err
+		}
+	}
 
-	crd, err := r.crdLister.Get(functionName + ".functions.knative.dev")
+	if resync {
+		r.functions.ResyncController(crd.Name)
+	}
+	return cms, nil
+}
+
+// patchConfigMapLabels adds labels to the configmap cm.
+func (r *Reconciler) patchConfigMapLabels(cm *corev1.ConfigMap, labels map[string]string) (*corev1.ConfigMap, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	})
 	if err != nil {
-		logger.Error("Failed to get function Custom Resource Definition", zap.Error(err))
-		return nil, fmt.Errorf("Failed to get function Custom Resource Definition: %v", err)
+		return nil, err
 	}
+	return r.kubeClient.CoreV1().ConfigMaps(cm.Namespace).Patch(cm.Name, types.MergePatchType, patch)
+}
+
+// reconcileService reconciles the Knative service index among the count
+// services of the CRD.
+func (r *Reconciler) reconcileService(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition, index, count int, cms []*corev1.ConfigMap) (*servingv1beta1.Service, error) {
+	logger := logging.FromContext(ctx)
 
 	image, ok := crd.Annotations["functions.knative.dev/image"]
 	if !ok {
-		logger.Error("Missing functions.knative.dev/image annotation on function CRD", zap.Any("functionName", functionName))
+		logger.Error("Missing functions.knative.dev/image annotation on function CRD", zap.String("crd", crd.Name))
 		return nil, errors.New("Missing functions.knative.dev/image annotation on function CRD")
 	}
 
-	expected := resources.MakeKnativeService(functionName, cm.ResourceVersion, image)
+	ns := config.FromContext(ctx).RuntimeNamespace
+	gr := functionGroupResource(crd)
+	serviceName := names.ServiceShardName(gr, index)
+	cmnames := make([]string, len(cms))
+	for i, cm := range cms {
+		cmnames[i] = cm.Name
+	}
+	format := shards.Format(cms[0])
+	reload, err := configReload(crd, format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Runtimes reloading the configuration keep serving the same revision.
+	// The version is only set when the service is created.
+	version := ""
+	if reload == duckv1alpha1.RevisionReload {
+		version, err = shards.Version(cms)
+		if err != nil {
+			logger.Error("Unable to compute the function configuration version", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	expected := resources.MakeKnativeService(ns, serviceName, cmnames, format, version, image)
+	expected.Labels = map[string]string{
+		fnresources.FunctionRuntimeLabel: names.ServiceName(gr),
+		crdNameLabel:                     crd.Name,
+	}
+	expected.Annotations = map[string]string{
+		duckv1alpha1.ReloadAnnotation: reload,
+	}
+	if index == 0 {
+		expected.Annotations[duckv1alpha1.ServiceCountAnnotation] = strconv.Itoa(count)
+	}
 
 	// Update service annotation with config map UUID.
-	service, err := r.serviceLister.Services("knative-functions").Get(functionName)
+	service, err := r.serviceLister.Services(ns).Get(serviceName)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
 
-			ksvc, err := r.servingClient.ServingV1beta1().Services("knative-functions").Create(expected)
+			ksvc, err := r.servingClient.ServingV1beta1().Services(ns).Create(expected)
 			if err != nil {
 				logger.Error("Failed to create the function service", zap.Error(err))
 				return nil, fmt.Errorf("Failed to create the function service: %v", err)
 			}
+			r.Recorder.Eventf(crd, corev1.EventTypeNormal, "ServiceCreated", "Created function service %s/%s", ns, serviceName)
 			return ksvc, nil
 		}
 
 		logger.Error("Unable to get the function service", zap.Error(err))
 		return nil, err
-	} else if !equality.Semantic.DeepEqual(expected.Spec, service.Spec) {
-		service = service.DeepCopy()
-		service.Spec = expected.Spec
+	} else if desired, drifted := syncService(service, expected, cmnames, format); drifted {
+		resync := index == 0 && fnresources.ServiceCount(service) != count
 
-		service, err = r.servingClient.ServingV1beta1().Services("knative-functions").Update(service)
+		service, err = r.servingClient.ServingV1beta1().Services(ns).Update(desired)
 		if err != nil {
 			logger.Error("Failed to update the function service", zap.Error(err))
 			return nil, fmt.Errorf("Failed to update the function service: %v", err)
 		}
+		r.Recorder.Eventf(crd, corev1.EventTypeNormal, "ServiceUpdated", "Updated function service %s/%s", ns, serviceName)
+
+		// Assign the instances to the new set of services.
+		if resync {
+			r.functions.ResyncController(crd.Name)
+		}
 	}
 
 	return service, nil
 }
+
+// configReload returns how the runtime of the CRD loads the configuration
+// changes, stored in format.
+func configReload(crd *duckv1alpha1.CustomResourceDefinition, format string) (string, error) {
+	switch reload := crd.Annotations[duckv1alpha1.ReloadAnnotation]; reload {
+	case "", duckv1alpha1.RevisionReload:
+		return duckv1alpha1.RevisionReload, nil
+	case duckv1alpha1.HotReload:
+		// Files mounted with a sub path are not updated.
+		if format != shards.EntriesFormat {
+			return "", fmt.Errorf("%s=%s requires the %s configuration format", duckv1alpha1.ReloadAnnotation, reload, shards.EntriesFormat)
+		}
+		return reload, nil
+	default:
+		return "", fmt.Errorf("unknown %s value %q", duckv1alpha1.ReloadAnnotation, reload)
+	}
+}
+
+// syncService returns a copy of service where the labels, annotations,
+// image and configuration volume set by the controller are reverted to
+// expected, and whether any of them drifted. The fields defaulted by
+// Knative are kept.
+//
+// The configuration version of the revision template is left alone: it is
+// only set by the function reconciler once all configuration changes are
+// written, so that a revision is not rolled out for intermediate versions.
+func syncService(service, expected *servingv1beta1.Service, cmnames []string, format string) (*servingv1beta1.Service, bool) {
+	drifted := !hasMetadata(service, expected)
+
+	service = service.DeepCopy()
+	service.Labels = mergeMap(service.Labels, expected.Labels)
+	service.Annotations = mergeMap(service.Annotations, expected.Annotations)
+
+	template := &service.Spec.Template
+	want := expected.Spec.Template
+
+	if len(template.Spec.Containers) == 0 {
+		template.Spec = want.Spec
+		return service, true
+	}
+
+	container := &template.Spec.Containers[0]
+	if container.Image != want.Spec.Containers[0].Image {
+		container.Image = want.Spec.Containers[0].Image
+		drifted = true
+	}
+
+	if len(template.Spec.Volumes) != len(want.Spec.Volumes) ||
+		len(container.VolumeMounts) != len(want.Spec.Containers[0].VolumeMounts) ||
+		!shards.Projects(template.Spec.PodSpec, cmnames, format) {
+		template.Spec.Volumes = want.Spec.Volumes
+		container.VolumeMounts = want.Spec.Containers[0].VolumeMounts
+		drifted = true
+	}
+
+	return service, drifted
+}
+
+// hasMetadata returns true when the labels and annotations of expected are
+// set on object.
+func hasMetadata(object, expected metav1.Object) bool {
+	labels := object.GetLabels()
+	for k, v := range expected.GetLabels() {
+		if labels[k] != v {
+			return false
+		}
+	}
+	annotations := object.GetAnnotations()
+	for k, v := range expected.GetAnnotations() {
+		if annotations[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeMap sets the entries of from in to, allocating to when nil.
+func mergeMap(to, from map[string]string) map[string]string {
+	if to == nil && len(from) > 0 {
+		to = make(map[string]string, len(from))
+	}
+	for k, v := range from {
+		to[k] = v
+	}
+	return to
+}
+
+// deleteUnusedServices deletes the Knative services of the CRD beyond the
+// first count ones, once no route sends traffic to them anymore.
+func (r *Reconciler) deleteUnusedServices(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition, count int) error {
+	logger := logging.FromContext(ctx)
+
+	ns := config.FromContext(ctx).RuntimeNamespace
+	services, err := r.serviceNames(crd, ns, count)
+	if err != nil || len(services) == 0 {
+		return err
+	}
+
+	routes, err := r.routeLister.Routes(ns).List(labels.SelectorFromSet(labels.Set{
+		fnresources.FunctionRoleLabel:    fnresources.FunctionRole,
+		fnresources.FunctionRuntimeLabel: names.ServiceName(functionGroupResource(crd)),
+	}))
+	if err != nil {
+		logger.Error("Unable to list function routes", zap.Error(err))
+		return err
+	}
+	for _, route := range routes {
+		for _, service := range services {
+			if fnresources.RouteService(route) == service {
+				return fmt.Errorf("waiting for route %q to move off service %q", route.Name, service)
+			}
+		}
+	}
+
+	for _, service := range services {
+		if err := r.deleteService(ctx, crd, ns, service); err != nil {
+			return err
+		}
+		if err := r.deleteConfig(ctx, crd, ns, service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceNames returns the names of the Knative services of the CRD in
+// namespace ns, but the first from ones. Services dedicated to a function
+// instance are only returned when from is 0.
+func (r *Reconciler) serviceNames(crd *duckv1alpha1.CustomResourceDefinition, ns string, from int) ([]string, error) {
+	gr := functionGroupResource(crd)
+
+	skip := make(map[string]bool)
+	for index := 0; index < from; index++ {
+		skip[names.ServiceShardName(gr, index)] = true
+	}
+
+	// Services created by previous versions are not labelled.
+	services := []string{}
+	if from == 0 {
+		services = append(services, names.ServiceName(gr))
+		skip[names.ServiceName(gr)] = true
+	}
+
+	list, err := r.serviceLister.Services(ns).List(labels.SelectorFromSet(labels.Set{
+		fnresources.FunctionRuntimeLabel: names.ServiceName(gr),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range list {
+		// Services dedicated to an instance are only deleted with the CRD.
+		if _, dedicated := service.Labels[fnresources.FunctionUIDLabel]; dedicated && from > 0 {
+			continue
+		}
+		if !skip[service.Name] {
+			services = append(services, service.Name)
+		}
+	}
+	return services, nil
+}
+
+// finalize tears down the runtime resources shared by the function instances
+// before releasing the finalizer.
+func (r *Reconciler) finalize(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition) error {
+	var err error
+	// Function CRDs were protected by a finalizer in previous versions. The
+	// deletion is now denied by the webhook while instances remain.
+	if hasFinalizer(crd, legacyProtectionFinalizerName) {
+		if crd, err = r.removeFinalizer(crd, legacyProtectionFinalizerName); err != nil {
+			return err
+		}
+	}
+
+	if !hasFinalizer(crd, finalizerName) {
+		return nil
+	}
+
+	// The function controller is stopped: release the function instances,
+	// including those being deleted with the CRD, so they can be garbage
+	// collected.
+	if err := r.releaseFunctions(ctx, crd); err != nil {
+		return err
+	}
+
+	serviceNamespace, configNamespace := runtimeNamespaces(crd)
+
+	if err := r.deleteRoutes(ctx, crd, serviceNamespace); err != nil {
+		return err
+	}
+
+	services, err := r.serviceNames(crd, serviceNamespace, 0)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := r.deleteService(ctx, crd, serviceNamespace, service); err != nil {
+			return err
+		}
+
+		if err := r.deleteConfig(ctx, crd, configNamespace, service); err != nil {
+			return err
+		}
+	}
+
+	_, err = r.removeFinalizer(crd, finalizerName)
+	return err
+}
+
+// releaseFunctions removes the function finalizer from all instances of the CRD.
+func (r *Reconciler) releaseFunctions(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition) error {
+	logger := logging.FromContext(ctx)
+
+	client := r.dynamicClient.Resource(crd.FunctionResource())
+	list, err := client.Namespace(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		logger.Error("Unable to list function instances", zap.Error(err))
+		return err
+	}
+
+	for _, item := range list.Items {
+		finalizers := []string{}
+		for _, f := range item.GetFinalizers() {
+			if f != duckv1alpha1.FunctionFinalizer {
+				finalizers = append(finalizers, f)
+			}
+		}
+		if len(finalizers) == len(item.GetFinalizers()) {
+			continue
+		}
+
+		patch, err := makeFinalizersPatch(finalizers, item.GetResourceVersion())
+		if err != nil {
+			return err
+		}
+
+		_, err = client.Namespace(item.GetNamespace()).Patch(item.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			logger.Error("Failed to release function instance", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRoutes deletes the routes of all function instances of the CRD.
+func (r *Reconciler) deleteRoutes(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition, ns string) error {
+	logger := logging.FromContext(ctx)
+
+	selector := labels.SelectorFromSet(labels.Set{
+		fnresources.FunctionRoleLabel:    fnresources.FunctionRole,
+		fnresources.FunctionRuntimeLabel: names.ServiceName(functionGroupResource(crd)),
+	})
+
+	routes, err := r.routeLister.Routes(ns).List(selector)
+	if err != nil {
+		logger.Error("Unable to list function routes", zap.Error(err))
+		return err
+	}
+
+	for _, route := range routes {
+		err := r.servingClient.ServingV1beta1().Routes(route.Namespace).Delete(route.Name, &metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			logger.Error("Failed to delete function route", zap.Error(err))
+			return err
+		}
+	}
+
+	if len(routes) > 0 {
+		r.Recorder.Eventf(crd, corev1.EventTypeNormal, "RoutesDeleted", "Deleted %d function routes in %s", len(routes), ns)
+	}
+	return nil
+}
+
+// deleteService deletes the Knative service of the CRD called serviceName.
+func (r *Reconciler) deleteService(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition, ns, serviceName string) error {
+	logger := logging.FromContext(ctx)
+
+	err := r.servingClient.ServingV1beta1().Services(ns).Delete(serviceName, &metav1.DeleteOptions{})
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		logger.Error("Failed to delete the function service", zap.Error(err))
+		return err
+	}
+
+	r.Recorder.Eventf(crd, corev1.EventTypeNormal, "ServiceDeleted", "Deleted function service %s/%s", ns, serviceName)
+	return nil
+}
+
+// deleteConfig deletes the configmaps of the Knative service of the CRD called serviceName.
+func (r *Reconciler) deleteConfig(ctx context.Context, crd *duckv1alpha1.CustomResourceDefinition, ns, serviceName string) error {
+	logger := logging.FromContext(ctx)
+
+	deleted, err := shards.NewClient(r.kubeClient.CoreV1(), r.configMapLister, ns, serviceName).Delete()
+	if err != nil {
+		logger.Error("Failed to delete the function configmaps", zap.Error(err))
+		return err
+	}
+
+	for _, cmname := range deleted {
+		r.Recorder.Eventf(crd, corev1.EventTypeNormal, "ConfigMapDeleted", "Deleted function configmap %s/%s", ns, cmname)
+	}
+	return nil
+}
+
+func hasFinalizer(crd metav1.Object, name string) bool {
+	for _, f := range crd.GetFinalizers() {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reconciler) addFinalizer(crd *duckv1alpha1.CustomResourceDefinition) error {
+	if hasFinalizer(crd, finalizerName) {
+		return nil
+	}
+	_, err := r.patchFinalizers(crd, append(crd.Finalizers, finalizerName))
+	return err
+}
+
+func (r *Reconciler) removeFinalizer(crd *duckv1alpha1.CustomResourceDefinition, name string) (*duckv1alpha1.CustomResourceDefinition, error) {
+	finalizers := []string{}
+	for _, f := range crd.Finalizers {
+		if f != name {
+			finalizers = append(finalizers, f)
+		}
+	}
+	return r.patchFinalizers(crd, finalizers)
+}
+
+func (r *Reconciler) patchFinalizers(crd *duckv1alpha1.CustomResourceDefinition, finalizers []string) (*duckv1alpha1.CustomResourceDefinition, error) {
+	patch, err := makeFinalizersPatch(finalizers, crd.ResourceVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.patchCRD(crd.Name, patch)
+}
+
+func (r *Reconciler) patchCRD(name string, patch []byte) (*duckv1alpha1.CustomResourceDefinition, error) {
+	untyped, err := r.crdClient.Patch(name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return toCRD(untyped)
+}
+
+// getCRD returns the CRD called name listed by lister.
+func getCRD(lister cache.GenericLister, name string) (*duckv1alpha1.CustomResourceDefinition, error) {
+	obj, err := lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	untyped, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	return toCRD(untyped)
+}
+
+// functionGroupResource returns the group and resource of the function defined by the CRD.
+func functionGroupResource(crd *duckv1alpha1.CustomResourceDefinition) schema.GroupResource {
+	return schema.GroupResource{Group: crd.Spec.Group, Resource: crd.Spec.Names.Plural}
+}
+
+func toCRD(untyped *unstructured.Unstructured) (*duckv1alpha1.CustomResourceDefinition, error) {
+	crd := &duckv1alpha1.CustomResourceDefinition{}
+	if err := duck.FromUnstructured(untyped, crd); err != nil {
+		return nil, err
+	}
+	return crd, nil
+}
+
+// makeFinalizersPatch returns a merge patch replacing the finalizers of an
+// object, failing if the object changed since it was read.
+func makeFinalizersPatch(finalizers []string, resourceVersion string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": resourceVersion,
+		},
+	})
+}
@@ -19,10 +19,13 @@ package resources
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/shards"
 )
 
-// MakeConfigMap creates a new configmap for a Function.
-func MakeConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
+// MakeConfigMap creates a new configmap for a Function, storing
+// configurations in format.
+func MakeConfigMap(namespace, name, format string) (*corev1.ConfigMap, error) {
 	// Add annotations
 	cm := &corev1.ConfigMap{
 		TypeMeta: metav1.TypeMeta{
@@ -32,10 +35,15 @@ func MakeConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
+			Annotations: map[string]string{
+				shards.FormatAnnotation: format,
+			},
 		},
-		Data: map[string]string{
-			"___config.json": "{}",
-		},
+		Data: map[string]string{},
+	}
+
+	if format == shards.FileFormat {
+		cm.Data[shards.ConfigKey] = "{}"
 	}
 
 	return cm, nil
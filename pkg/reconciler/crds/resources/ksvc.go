@@ -22,51 +22,42 @@ import (
 	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
 
 	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/shards"
 )
 
-// MakeKnativeService create a knative service
-func MakeKnativeService(functionName string, version, image string) *servingv1beta1.Service {
+// MakeKnativeService create a knative service projecting the configuration
+// shards called configMapNames, stored in format. The revision template
+// records the configuration version, unless empty.
+func MakeKnativeService(namespace, name string, configMapNames []string, format, version, image string) *servingv1beta1.Service {
+	volume, mounts := shards.Volume(configMapNames, format)
+	var annotations map[string]string
+	if version != "" {
+		annotations = map[string]string{duckv1alpha1.ConfigMapAnnotation: version}
+	}
 	return &servingv1beta1.Service{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "v1beta1",
 			Kind:       "Service",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      functionName,
-			Namespace: "knative-functions",
+			Name:      name,
+			Namespace: namespace,
 		},
 		Spec: servingv1beta1.ServiceSpec{
 			ConfigurationSpec: servingv1beta1.ConfigurationSpec{
 				Template: servingv1beta1.RevisionTemplateSpec{
 					ObjectMeta: metav1.ObjectMeta{
-						Annotations: map[string]string{duckv1alpha1.ConfigMapAnnotation: version},
+						Annotations: annotations,
 					},
 					Spec: servingv1beta1.RevisionSpec{
 						PodSpec: corev1.PodSpec{
 							Containers: []corev1.Container{
 								corev1.Container{
-									Image: image,
-									VolumeMounts: []corev1.VolumeMount{
-										corev1.VolumeMount{
-											Name:      "config-function-" + functionName,
-											MountPath: "/ko-app/___config.json",
-											SubPath:   "___config.json",
-										},
-									},
-								},
-							},
-							Volumes: []corev1.Volume{
-								corev1.Volume{
-									Name: "config-function-" + functionName,
-									VolumeSource: corev1.VolumeSource{
-										ConfigMap: &corev1.ConfigMapVolumeSource{
-											LocalObjectReference: corev1.LocalObjectReference{
-												Name: "config-function-" + functionName,
-											},
-										},
-									},
+									Image:        image,
+									VolumeMounts: mounts,
 								},
 							},
+							Volumes: []corev1.Volume{volume},
 						},
 					},
 				},
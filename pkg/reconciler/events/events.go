@@ -0,0 +1,80 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package events records the events of the reconcilers as Kubernetes
+// Event resources.
+package events
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// burstSize is the number of events recorded at once for an object
+	// before being rate limited.
+	burstSize = 10
+
+	// qps is the rate at which events are recorded for an object once
+	// the burst is exhausted, one every 5 minutes.
+	qps = 1. / 300
+
+	// maxEvents is the number of events with the same reason recorded
+	// for an object within maxIntervalInSeconds before being aggregated
+	// into a single event, whatever their message.
+	maxEvents = 5
+
+	// maxIntervalInSeconds is the interval of the aggregation of similar
+	// events.
+	maxIntervalInSeconds = 600
+)
+
+// NewRecorder returns the recorder of the events of the component, sending
+// them to the API server until ctx is done. The recorder attached to ctx,
+// if any, is returned instead.
+func NewRecorder(ctx context.Context, client kubernetes.Interface, component string) record.EventRecorder {
+	if recorder := controller.GetEventRecorder(ctx); recorder != nil {
+		return recorder
+	}
+
+	logger := logging.FromContext(ctx)
+
+	// Failing reconciles are retried, emitting the same events again.
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize:            burstSize,
+		QPS:                  qps,
+		MaxEvents:            maxEvents,
+		MaxIntervalInSeconds: maxIntervalInSeconds,
+	})
+	logging := broadcaster.StartLogging(logger.Named("event-broadcaster").Infof)
+	sink := broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: client.CoreV1().Events(""),
+	})
+	go func() {
+		<-ctx.Done()
+		logging.Stop()
+		sink.Stop()
+	}()
+
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
+}
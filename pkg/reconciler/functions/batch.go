@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// batcher coalesces the configuration changes of the instances of a
+// function kind. The changes made to the configuration of a service within
+// the batch window are written at once, rolling the service once.
+//
+// Pending batches are dropped once the controller of the kind is stopped,
+// so that the runtime of a kind being torn down is not written.
+type batcher struct {
+	ctx context.Context
+
+	mu      sync.Mutex
+	batches map[string]*batch
+
+	// flush writes the changes of the batch of a service.
+	flush func(service string, b *batch)
+}
+
+// batch holds the pending configuration changes of a service.
+type batch struct {
+	// changes are the configurations to write, by key. Configurations to
+	// remove are nil.
+	changes map[string]interface{}
+
+	// functions are the instances to reconcile once the changes are written.
+	functions map[types.NamespacedName]struct{}
+
+	// timer flushes the batch at the end of the window.
+	timer *time.Timer
+}
+
+// newBatcher returns a batcher dropping its pending batches when ctx is done.
+func newBatcher(ctx context.Context, flush func(service string, b *batch)) *batcher {
+	b := &batcher{
+		ctx:     ctx,
+		batches: make(map[string]*batch),
+		flush:   flush,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for service, pending := range b.batches {
+			pending.timer.Stop()
+			delete(b.batches, service)
+		}
+	}()
+
+	return b
+}
+
+// add records the change of the configuration stored under key in the
+// configuration of service, made by the instance fn. A nil value removes
+// the configuration. The batch of service is flushed window after its
+// first change. Changes made once the controller is stopped are dropped.
+func (b *batcher) add(service, key string, value interface{}, fn types.NamespacedName, window time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ctx.Err() != nil {
+		return
+	}
+
+	pending, ok := b.batches[service]
+	if !ok {
+		pending = &batch{
+			changes:   make(map[string]interface{}),
+			functions: make(map[types.NamespacedName]struct{}),
+		}
+		b.batches[service] = pending
+
+		pending.timer = time.AfterFunc(window, func() {
+			b.mu.Lock()
+			if b.batches[service] != pending {
+				// Dropped when the controller stopped.
+				b.mu.Unlock()
+				return
+			}
+			delete(b.batches, service)
+			b.mu.Unlock()
+
+			b.flush(service, pending)
+		})
+	}
+
+	pending.changes[key] = value
+	pending.functions[fn] = struct{}{}
+}
@@ -19,29 +19,44 @@ package functions
 import (
 	"context"
 	"fmt"
+	"net/http"
 
-	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/tools/record"
-	crdinformers "knative.dev/pkg/client/injection/apiextensions/informers/apiextensions/v1beta1/customresourcedefinition"
+	"k8s.io/client-go/tools/cache"
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	configmapinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/configmap"
+	endpointsinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/endpoints"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
 	"knative.dev/pkg/injection"
 	"knative.dev/pkg/injection/clients/dynamicclient"
+	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
+	"knative.dev/pkg/tracker"
+	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
 	servingclient "knative.dev/serving/pkg/client/injection/client"
+	revisioninformer "knative.dev/serving/pkg/client/injection/informers/serving/v1beta1/revision"
 	routeinformer "knative.dev/serving/pkg/client/injection/informers/serving/v1beta1/route"
 	serviceinformer "knative.dev/serving/pkg/client/injection/informers/serving/v1beta1/service"
 
 	"github.com/lionelvillard/knative-functions-controller/pkg/dynamic"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/config"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/events"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/functions/resources"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/manager"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
 )
 
 const (
 	controllerAgentName = "functions-controller"
 )
 
+var (
+	routeGVK    = servingv1beta1.SchemeGroupVersion.WithKind("Route")
+	serviceGVK  = servingv1beta1.SchemeGroupVersion.WithKind("Service")
+	revisionGVK = servingv1beta1.SchemeGroupVersion.WithKind("Revision")
+)
+
 // NewController returns a new Function reconcile controller.
 func NewController(gvr schema.GroupVersionResource) injection.ControllerConstructor {
 	return func(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
@@ -50,25 +65,71 @@ func NewController(gvr schema.GroupVersionResource) injection.ControllerConstruc
 		routeInformer := routeinformer.Get(ctx)
 		dynamicInformer := dynamic.Get(ctx, gvr)
 		serviceInformer := serviceinformer.Get(ctx)
-		crdInformer := crdinformers.Get(ctx)
+		revisionInformer := revisioninformer.Get(ctx)
+		configMapInformer := configmapinformer.Get(ctx)
+		endpointsInformer := endpointsinformer.Get(ctx)
 
 		c := &Reconciler{
-			kubeClient:    kubeclient.Get(ctx),
-			dynamicClient: dynamicclient.Get(ctx).Resource(gvr),
-			servingClient: servingclient.Get(ctx),
-			routeLister:   routeInformer.Lister(),
-			serviceLister: serviceInformer.Lister(),
-			crdLister:     crdInformer.Lister(),
-			Recorder: record.NewBroadcaster().NewRecorder(
-				scheme.Scheme, corev1.EventSource{Component: controllerAgentName}),
-			functionName: gvr.Resource,
+			kubeClient:      kubeclient.Get(ctx),
+			dynamicClient:   dynamicclient.Get(ctx).Resource(gvr),
+			servingClient:   servingclient.Get(ctx),
+			routeLister:     routeInformer.Lister(),
+			serviceLister:   serviceInformer.Lister(),
+			revisionLister:  revisionInformer.Lister(),
+			configMapLister: configMapInformer.Lister(),
+			endpointsLister: endpointsInformer.Lister(),
+			Recorder:        events.NewRecorder(ctx, kubeclient.Get(ctx), controllerAgentName),
+			httpClient:      &http.Client{},
+			gvr:             gvr,
+			configStore:     config.GetStore(ctx),
+			specChanges:     newSpecChanges(),
 		}
 		impl := controller.NewImpl(c, logger, fmt.Sprintf("%s-function", gvr.Resource))
 
+		c.batcher = newBatcher(ctx, func(service string, b *batch) {
+			c.flushConfig(ctx, service, b)
+		})
+		c.enqueue = impl.EnqueueKey
+		c.enqueueAfter = impl.EnqueueKeyAfter
+		c.Tracker = tracker.New(impl.EnqueueKey, controller.GetTrackerLease(ctx))
+
 		logger.Info("Setting up event handlers")
 
 		dynamicInformer.Informer().AddEventHandler(controller.HandleAll(impl.Enqueue))
 
+		// Reconcile the instances served by the routes and services of the
+		// kind when they change, for instance when they become ready. The
+		// informers are shared: the handlers are removed by the manager when
+		// the controller stops.
+		manager.AddEventHandler(ctx, routeInformer.Informer(), cache.FilteringResourceEventHandler{
+			FilterFunc: runtimeOf(gvr.GroupResource()),
+			Handler:    controller.HandleAll(controller.EnsureTypeMeta(c.Tracker.OnChanged, routeGVK)),
+		})
+		manager.AddEventHandler(ctx, serviceInformer.Informer(), cache.FilteringResourceEventHandler{
+			FilterFunc: runtimeOf(gvr.GroupResource()),
+			Handler:    controller.HandleAll(controller.EnsureTypeMeta(c.Tracker.OnChanged, serviceGVK)),
+		})
+		// Revisions don't carry the labels of their service. Only the
+		// tracked revisions reconcile instances.
+		manager.AddEventHandler(ctx, revisionInformer.Informer(),
+			controller.HandleAll(controller.EnsureTypeMeta(c.Tracker.OnChanged, revisionGVK)))
+
+		manager.AddEventHandler(ctx, revisionInformer.Informer(), reportRevisions(ctx, gvr.GroupResource(), serviceInformer.Lister()))
+		go reportInstances(ctx, gvr.GroupResource().String(), dynamicInformer.Informer())
+
 		return impl
 	}
 }
+
+// runtimeOf returns a filter accepting the routes and services running the
+// function kind gr.
+func runtimeOf(gr schema.GroupResource) func(obj interface{}) bool {
+	runtime := names.ServiceName(gr)
+	return func(obj interface{}) bool {
+		object, err := kmeta.DeletionHandlingAccessor(obj)
+		if err != nil {
+			return false
+		}
+		return object.GetLabels()[resources.FunctionRuntimeLabel] == runtime
+	}
+}
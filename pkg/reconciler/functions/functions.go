@@ -20,32 +20,39 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"net/http"
+	"time"
 
 	"github.com/knative/eventing/pkg/utils"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
-	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"knative.dev/pkg/apis"
 	"knative.dev/pkg/apis/duck"
 	"knative.dev/pkg/controller"
 	"knative.dev/pkg/logging"
-	"knative.dev/pkg/system"
 	"knative.dev/pkg/tracker"
 	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
 	servingclient "knative.dev/serving/pkg/client/clientset/versioned"
 	servingv1beta1listers "knative.dev/serving/pkg/client/listers/serving/v1beta1"
 
 	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/config"
+	crdresources "github.com/lionelvillard/knative-functions-controller/pkg/reconciler/crds/resources"
 	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/functions/resources"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/shards"
 )
 
 // Reconciler implements controller.Reconciler for dynamic resources.
@@ -65,8 +72,14 @@ type Reconciler struct {
 	// serviceLister index properties about Knative services
 	serviceLister servingv1beta1listers.ServiceLister
 
-	// crdLister index properties about CRDs
-	crdLister apiextensionsv1beta1.CustomResourceDefinitionLister
+	// revisionLister index properties about Knative revisions
+	revisionLister servingv1beta1listers.RevisionLister
+
+	// configMapLister index properties about configmaps
+	configMapLister corev1listers.ConfigMapLister
+
+	// endpointsLister index properties about the endpoints of the revisions
+	endpointsLister corev1listers.EndpointsLister
 
 	// The tracker builds an index of what resources are watching other
 	// resources so that we can immediately react to changes to changes in
@@ -77,16 +90,39 @@ type Reconciler struct {
 	// Kubernetes API.
 	Recorder record.EventRecorder
 
-	// Function name (eg. filter)
-	functionName string
+	// The function resource (eg. filters.functions.knative.dev/v1alpha1)
+	gvr schema.GroupVersionResource
+
+	// configStore holds the controller configuration
+	configStore *config.Store
+
+	// batcher coalesces the configuration changes of the instances
+	batcher *batcher
+
+	// enqueue reconciles the instance with the given key
+	enqueue func(types.NamespacedName)
+
+	// enqueueAfter reconciles the instance with the given key after a delay
+	enqueueAfter func(types.NamespacedName, time.Duration)
+
+	// httpClient probes the runtimes reloading the configuration
+	httpClient *http.Client
+
+	// specChanges records when the spec of the instances changed
+	specChanges *specChanges
 }
 
 // Check that our Reconciler implements controller.Reconciler
 var _ controller.Reconciler = (*Reconciler)(nil)
 
 // Reconcile implements controller.Reconciler
-func (r *Reconciler) Reconcile(ctx context.Context, key string) error {
+func (r *Reconciler) Reconcile(ctx context.Context, key string) (err error) {
+	defer func(start time.Time) {
+		reportReconcile(ctx, r.gvr.GroupResource().String(), time.Since(start), err)
+	}(time.Now())
+
 	logger := logging.FromContext(ctx)
+	ctx = r.configStore.ToContext(ctx)
 
 	// Convert the namespace/name string into a distinct namespace and name
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
@@ -132,19 +168,32 @@ func (r *Reconciler) Reconcile(ctx context.Context, key string) error {
 func (r *Reconciler) reconcile(ctx context.Context, fn *duckv1alpha1.Function) error {
 	if fn.GetDeletionTimestamp() != nil {
 		// Check for a DeletionTimestamp.  If present, elide the normal reconcile logic.
-		// When a controller needs finalizer handling, it would go here.
-		return nil
+		r.specChanges.forget(fn)
+		return r.finalize(ctx, fn)
 	}
+	r.specChanges.observe(fn)
 	fn.Status.InitializeConditions()
 
+	if err := r.addFinalizer(fn); err != nil {
+		return err
+	}
+
 	// Make sure the function service  exists
 
-	svc, err := r.checkService(ctx, r.functionName)
+	svc, err := r.checkService(ctx, fn)
 	if err != nil {
-		fn.Status.MarkServiceNotSynced("CheckExistFailed", err.Error())
+		fn.Status.MarkServiceNotReady(duckv1alpha1.ReasonServiceCheckFailed, "%v", err)
 		return err
 	}
 
+	if resources.IsDedicated(fn) {
+		svc, err = r.reconcileDedicatedService(ctx, fn, svc)
+		if err != nil {
+			fn.Status.MarkServiceNotReady(duckv1alpha1.ReasonDedicatedServiceFailed, "%v", err)
+			return err
+		}
+	}
+
 	err = r.propagateServiceStatusIfError(ctx, fn, svc)
 	if err != nil {
 		return err
@@ -152,9 +201,9 @@ func (r *Reconciler) reconcile(ctx context.Context, fn *duckv1alpha1.Function) e
 
 	// Add new route
 
-	route, err := r.reconcileRoute(ctx, fn)
+	route, err := r.reconcileRoute(ctx, fn, svc.Name)
 	if err != nil {
-		fn.Status.MarkRouteNotReady("ReconcileFailed", "%v", err)
+		fn.Status.MarkRouteNotReady(duckv1alpha1.ReasonRouteReconcileFailed, "%v", err)
 		return err
 	}
 
@@ -163,19 +212,65 @@ func (r *Reconciler) reconcile(ctx context.Context, fn *duckv1alpha1.Function) e
 		return err
 	}
 
-	cm, err := r.reconcileConfig(ctx, fn, route)
+	cms, pending, err := r.reconcileConfig(ctx, fn, route, svc.Name)
 	if err != nil {
-		fn.Status.MarkConfigMapNotSynced("UpdateFailed", err.Error())
+		fn.Status.MarkConfigMapNotSynced(duckv1alpha1.ReasonUpdateFailed, "%v", err)
 		return err
 	}
+	if pending {
+		// The instance is reconciled again once the batch is written.
+		fn.Status.MarkConfigMapPending(duckv1alpha1.ReasonConfigPending, "Waiting for the configuration of service %s to be written", svc.Name)
+		return nil
+	}
+	if c := fn.Status.GetCondition(duckv1alpha1.FunctionConditionConfigMapSynced); c != nil && c.Reason == duckv1alpha1.ReasonConfigPending {
+		r.Recorder.Eventf(fn, corev1.EventTypeNormal, "ConfigSynced", "Wrote the configuration to service %s", svc.Name)
+	}
 	fn.Status.MarkConfigMapSynced()
 
-	_, err = r.reconcileService(ctx, svc, cm)
+	// Batched configuration changes roll the service when written. The
+	// service is rolled here when that failed, or when the controller
+	// restarted in between.
+	hot := resources.IsHotReloaded(svc)
+	stale, err := isStale(svc, cms)
 	if err != nil {
-		fn.Status.MarkServiceNotSynced("UpdateFailed", err.Error())
+		fn.Status.MarkServiceNotReady(duckv1alpha1.ReasonUpdateFailed, "%v", err)
 		return err
 	}
-	fn.Status.MarkServiceSynced()
+	if config.FromContext(ctx).ConfigBatchWindow == 0 || hot || stale {
+		svc, err = r.reconcileService(ctx, svc, cms)
+		if err != nil {
+			fn.Status.MarkServiceNotReady(duckv1alpha1.ReasonUpdateFailed, "%v", err)
+			return err
+		}
+	}
+	fn.Status.MarkServiceReady()
+
+	if hot {
+		loaded, err := r.checkReload(ctx, fn, svc, cms, configKey(route.Name, route.Namespace))
+		if err != nil || !loaded {
+			return err
+		}
+	}
+
+	if previous := resources.RouteService(route); previous != svc.Name && !resources.IsUnmanaged(route) {
+		route, err = r.moveRoute(ctx, fn, route, svc, cms)
+		if err != nil {
+			fn.Status.MarkRouteNotReady(duckv1alpha1.ReasonRouteMoveFailed, "%v", err)
+			return err
+		}
+		if previous != names.DedicatedServiceName(r.gvr.GroupResource(), fn.Namespace, fn.Name) {
+			if err := r.releaseService(ctx, fn, previous, configKey(route.Name, route.Namespace)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The instance may have been moved back to a shared service.
+	if !resources.IsDedicated(fn) {
+		if err := r.deleteDedicatedService(ctx, fn); err != nil {
+			return err
+		}
+	}
 
 	fn.Status.SetAddress(&apis.URL{
 		Scheme: "http",
@@ -183,27 +278,40 @@ func (r *Reconciler) reconcile(ctx context.Context, fn *duckv1alpha1.Function) e
 	})
 
 	fn.Status.URL = route.Status.URL
+
+	if !hot {
+		if err := r.checkRevision(ctx, fn, svc, cms, configKey(route.Name, route.Namespace)); err != nil {
+			return err
+		}
+	}
+
 	fn.Status.ObservedGeneration = fn.Generation
 	return nil
 }
 
-func (r *Reconciler) reconcileRoute(ctx context.Context, fn *duckv1alpha1.Function) (*servingv1beta1.Route, error) {
+func (r *Reconciler) reconcileRoute(ctx context.Context, fn *duckv1alpha1.Function, service string) (*servingv1beta1.Route, error) {
 	logger := logging.FromContext(ctx)
 
 	// Get the  Route and propagate the status to the Function in case it does not exist.
-	route, err := r.routeLister.Routes("knative-functions").Get(resources.MakeRouteName(r.functionName, fn.Name, fn.Namespace))
+	ns := config.FromContext(ctx).RuntimeNamespace
+	gr := r.gvr.GroupResource()
+	if err := r.track(fn, routeGVK, ns, names.RouteName(gr, fn.Namespace, fn.Name)); err != nil {
+		return nil, err
+	}
+	route, err := r.routeLister.Routes(ns).Get(names.RouteName(gr, fn.Namespace, fn.Name))
 	if err != nil {
 		if apierrs.IsNotFound(err) {
-			route, err = resources.MakeRoute(r.functionName, fn)
+			route, err = resources.MakeRoute(ns, gr, fn, service)
 			if err != nil {
 				logger.Error("Failed to create the function route object", zap.Error(err))
 				return nil, err
 			}
-			route, err = r.servingClient.ServingV1beta1().Routes("knative-functions").Create(route)
+			route, err = r.servingClient.ServingV1beta1().Routes(ns).Create(route)
 			if err != nil {
 				logger.Error("Failed to create the function route", zap.Error(err))
 				return nil, err
 			}
+			r.Recorder.Eventf(fn, corev1.EventTypeNormal, "RouteCreated", "Created route %s/%s", ns, route.Name)
 			return route, nil
 		}
 
@@ -211,21 +319,123 @@ func (r *Reconciler) reconcileRoute(ctx context.Context, fn *duckv1alpha1.Functi
 		return nil, err
 	}
 
-	// Check to make sure that the Function owns this service and if not, complain.
-	if !metav1.IsControlledBy(route, fn) {
+	// Routes created by previous versions are owned through a
+	// cross-namespace owner reference or lack some ownership labels.
+	if resources.NeedsMigration(route, gr, fn) {
+		route, err = r.servingClient.ServingV1beta1().Routes(ns).Update(resources.MigrateRoute(route, gr, fn))
+		if err != nil {
+			logger.Error("Failed to migrate the function route", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	// Check to make sure that the Function owns this route and if not, complain.
+	if !resources.IsOwnedBy(route, fn) {
 		return nil, fmt.Errorf("Function: %s/%s does not own Route: %q", fn.Namespace, fn.Name, route.Name)
 	}
 
+	if resources.IsUnmanaged(route) {
+		return route, nil
+	}
+
+	// Keep sending the traffic to the current service until the function
+	// is moved to service.
+	target := resources.RouteService(route)
+	if target == "" {
+		target = service
+	}
+	expected, err := resources.MakeRoute(ns, gr, fn, target)
+	if err != nil {
+		logger.Error("Failed to create the function route object", zap.Error(err))
+		return nil, err
+	}
+	if desired, drifted := resources.SyncRoute(route, expected); drifted {
+		route, err = r.servingClient.ServingV1beta1().Routes(ns).Update(desired)
+		if err != nil {
+			logger.Error("Failed to update the function route", zap.Error(err))
+			return nil, err
+		}
+		r.Recorder.Eventf(fn, corev1.EventTypeNormal, "RouteUpdated", "Reverted the changes made to route %s/%s", ns, route.Name)
+	}
+
+	return route, nil
+}
+
+// moveRoute sends the traffic of the function route to the service, once
+// that service serves the configuration of the function, stored in cms.
+func (r *Reconciler) moveRoute(ctx context.Context, fn *duckv1alpha1.Function, route *servingv1beta1.Route, service *servingv1beta1.Service, cms []*corev1.ConfigMap) (*servingv1beta1.Route, error) {
+	logger := logging.FromContext(ctx)
+
+	if service.Generation != service.Status.ObservedGeneration || !service.Status.IsReady() {
+		return nil, fmt.Errorf("waiting for service %s to be ready before moving the route %s", service.Name, route.Name)
+	}
+
+	// The service may be stale. Its latest ready revision must carry the
+	// configuration, unless the runtime reloaded it.
+	if !resources.IsHotReloaded(service) {
+		expected, err := shards.Version(cms)
+		if err != nil {
+			return nil, err
+		}
+		version, err := r.revisionVersion(ctx, fn, service)
+		if err != nil {
+			return nil, err
+		}
+		if version != expected {
+			return nil, fmt.Errorf("waiting for service %s to roll out configuration %s before moving the route %s", service.Name, expected, route.Name)
+		}
+	}
+
+	route = route.DeepCopy()
+	route.Spec.Traffic = resources.MakeTraffic(service.Name)
+	route, err := r.servingClient.ServingV1beta1().Routes(route.Namespace).Update(route)
+	if err != nil {
+		logger.Error("Failed to move the function route", zap.Error(err))
+		return nil, err
+	}
+	r.Recorder.Eventf(fn, corev1.EventTypeNormal, "RouteMoved", "Moved route %s/%s to service %s", route.Namespace, route.Name, service.Name)
 	return route, nil
 }
 
+// releaseService removes the configuration stored under key from the
+// service the function was previously served by.
+func (r *Reconciler) releaseService(ctx context.Context, fn *duckv1alpha1.Function, service string, key string) error {
+	logger := logging.FromContext(ctx)
+
+	if window := config.FromContext(ctx).ConfigBatchWindow; window > 0 {
+		r.batcher.add(service, key, nil, types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name}, window)
+		return nil
+	}
+
+	cms, err := r.removeConfig(ctx, service, key)
+	if err != nil || cms == nil {
+		return err
+	}
+
+	ns := config.FromContext(ctx).RuntimeNamespace
+	svc, err := r.serviceLister.Services(ns).Get(service)
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		logger.Error("Unable to get the function service", zap.Error(err))
+		return err
+	}
+
+	if _, err = r.reconcileService(ctx, svc, cms); err != nil {
+		logger.Error("Failed to update the function service", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 func (r *Reconciler) propagateRouteStatus(ctx context.Context, fn *duckv1alpha1.Function, route *servingv1beta1.Route) error {
 	c := route.Status.GetCondition(servingv1beta1.RouteConditionReady)
 	if c == nil || c.Status != corev1.ConditionTrue {
 		if c == nil {
-			fn.Status.MarkRouteNotReady("Unknown", "")
+			fn.Status.MarkRouteNotReady(duckv1alpha1.ReasonStatusUnknown, "")
 		} else {
-			fn.Status.MarkRouteNotReady(c.Reason, c.Message)
+			fn.Status.MarkRouteNotReady(c.Reason, "%s", c.Message)
 		}
 		return fmt.Errorf("route is not ready")
 	}
@@ -233,106 +443,661 @@ func (r *Reconciler) propagateRouteStatus(ctx context.Context, fn *duckv1alpha1.
 	return nil
 }
 
-func (r *Reconciler) reconcileConfig(ctx context.Context, fn *duckv1alpha1.Function, route *servingv1beta1.Route) (*corev1.ConfigMap, error) {
+// reconcileConfig stores the configuration of fn in the configuration of
+// service. When configuration changes are batched, it returns true while the
+// configuration is waiting to be written.
+func (r *Reconciler) reconcileConfig(ctx context.Context, fn *duckv1alpha1.Function, route *servingv1beta1.Route, service string) ([]*corev1.ConfigMap, bool, error) {
 	logger := logging.FromContext(ctx)
-	cmname := fmt.Sprintf("config-function-%s", r.functionName)
+	client := r.configShards(ctx, service)
+
+	if route == nil || route.Status.Address == nil || route.Status.Address.URL == nil {
+		cms, err := client.Get()
+		if err != nil {
+			logger.Error("Unable to get the function configmap", zap.Error(err))
+			return nil, false, err
+		}
+		return cms, false, nil
+	}
+
+	key := configKey(route.Name, route.Namespace)
 
-	cm, err := r.kubeClient.CoreV1().ConfigMaps(system.Namespace()).Get(cmname, metav1.GetOptions{})
+	cms, err := client.Get()
 	if err != nil {
 		logger.Error("Unable to get the function configmap", zap.Error(err))
-		return nil, err
+		return nil, false, err
 	}
 
-	if route != nil {
-		update := false
+	expected, err := json.Marshal(fn.Spec)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok, err := shards.Value(cms, key)
+	if err != nil {
+		logger.Error("Unable to read the function configuration", zap.Error(err))
+		return nil, false, err
+	}
+	if ok && value == string(expected) {
+		return cms, false, nil
+	}
+
+	window := config.FromContext(ctx).ConfigBatchWindow
+	if window == 0 {
+		cms, err := client.Set(ctx, key, fn.Spec)
+		if err != nil {
+			logger.Error("Unable to update the function configuration", zap.Error(err))
+			return nil, false, err
+		}
+		r.Recorder.Eventf(fn, corev1.EventTypeNormal, "ConfigSynced", "Wrote the configuration to service %s", service)
+		return cms, false, nil
+	}
+
+	r.batcher.add(service, key, fn.Spec, types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name}, window)
+	return cms, true, nil
+}
+
+// checkReload returns true when the runtime served by svc has loaded the
+// configuration stored in cms, or still serves the configuration of fn
+// stored under key. Otherwise fn is reconciled again later.
+func (r *Reconciler) checkReload(ctx context.Context, fn *duckv1alpha1.Function, svc *servingv1beta1.Service, cms []*corev1.ConfigMap, key string) (bool, error) {
+	logger := logging.FromContext(ctx)
+
+	expected, instance, err := configVersions(cms, key)
+	if err != nil {
+		fn.Status.MarkConfigNotServed(duckv1alpha1.ReasonVersionFailed, "%v", err)
+		return false, err
+	}
+
+	loaded, err := r.probeConfigVersion(ctx, svc, expected)
+	if err != nil {
+		logger.Debugw("Unable to probe the configuration version of the function runtime", zap.Error(err))
+	}
+	if loaded {
+		r.markConfigServed(ctx, fn, svc, svc.Status.LatestReadyRevisionName, expected, instance)
+		return true, nil
+	}
+	if stillServed(fn, instance) {
+		return true, nil
+	}
+
+	fn.Status.MarkConfigNotServed(duckv1alpha1.ReasonReloading, "Waiting for service %s to load configuration %s", svc.Name, expected)
+	r.enqueueAfter(types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name}, reloadProbeInterval)
+	return false, nil
+}
+
+// checkRevision marks the configuration of fn as served once the latest ready
+// revision of svc carries the version of the configuration stored in cms.
+// Otherwise fn is reconciled again when svc or that revision changes.
+//
+// The configuration of fn, stored under key, stays served while only the
+// configurations of other instances change.
+func (r *Reconciler) checkRevision(ctx context.Context, fn *duckv1alpha1.Function, svc *servingv1beta1.Service, cms []*corev1.ConfigMap, key string) error {
+	expected, instance, err := configVersions(cms, key)
+	if err != nil {
+		fn.Status.MarkConfigNotServed(duckv1alpha1.ReasonVersionFailed, "%v", err)
+		return err
+	}
+
+	name := svc.Status.LatestReadyRevisionName
+	served := fn.Status.GetCondition(duckv1alpha1.FunctionConditionConfigServed)
+	if name != "" && name == fn.Status.Revision && expected == fn.Status.ConfigVersion && served.IsTrue() {
+		return nil
+	}
+
+	version, err := r.revisionVersion(ctx, fn, svc)
+	if err != nil {
+		return err
+	}
+	if version == expected {
+		r.markConfigServed(ctx, fn, svc, name, expected, instance)
+		return nil
+	}
+	if stillServed(fn, instance) {
+		return nil
+	}
+
+	fn.Status.MarkConfigNotServed(duckv1alpha1.ReasonRollingOut, "Waiting for service %s to roll out configuration %s", svc.Name, expected)
+	return nil
+}
+
+// revisionVersion returns the version of the configuration carried by the
+// latest ready revision of svc, if any. fn is reconciled again when that
+// revision changes.
+func (r *Reconciler) revisionVersion(ctx context.Context, fn *duckv1alpha1.Function, svc *servingv1beta1.Service) (string, error) {
+	logger := logging.FromContext(ctx)
+
+	name := svc.Status.LatestReadyRevisionName
+	if name == "" {
+		return "", nil
+	}
+	if err := r.track(fn, revisionGVK, svc.Namespace, name); err != nil {
+		return "", err
+	}
+	revision, err := r.revisionLister.Revisions(svc.Namespace).Get(name)
+	if apierrs.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		logger.Error("Unable to get the function revision", zap.Error(err))
+		return "", err
+	}
+	return revision.Annotations[duckv1alpha1.ConfigMapAnnotation], nil
+}
+
+// configVersions returns the version of the configuration stored in cms and
+// the version of the configuration stored under key.
+func configVersions(cms []*corev1.ConfigMap, key string) (string, string, error) {
+	version, err := shards.Version(cms)
+	if err != nil {
+		return "", "", err
+	}
+	instance, err := shards.EntryVersion(cms, key)
+	if err != nil {
+		return "", "", err
+	}
+	return version, instance, nil
+}
+
+// stillServed returns true when the configuration of fn, at version
+// instance, has already been served. The revisions rolled out for the
+// changes of other instances serve it as well.
+func stillServed(fn *duckv1alpha1.Function, instance string) bool {
+	served := fn.Status.GetCondition(duckv1alpha1.FunctionConditionConfigServed)
+	return served.IsTrue() && instance != "" && fn.Status.InstanceConfigVersion == instance
+}
+
+// markConfigServed marks the configuration version of fn as served by the
+// revision of svc, recording an event when the revision or the version
+// changed.
+func (r *Reconciler) markConfigServed(ctx context.Context, fn *duckv1alpha1.Function, svc *servingv1beta1.Service, revision, version, instance string) {
+	served := fn.Status.GetCondition(duckv1alpha1.FunctionConditionConfigServed)
+	if !served.IsTrue() || fn.Status.Revision != revision || fn.Status.ConfigVersion != version {
+		r.Recorder.Eventf(fn, corev1.EventTypeNormal, "ConfigServed", "Revision %s of service %s serves configuration %s", revision, svc.Name, version)
+		if latency, ok := r.specChanges.served(fn); ok {
+			reportConfigServed(ctx, r.gvr.GroupResource().String(), latency)
+		}
+	}
+	fn.Status.MarkConfigServed(revision, version, instance)
+}
 
-		if cm.Data == nil {
-			cm.Data = make(map[string]string)
-			update = true
+// flushConfig writes the configuration changes batched for service and rolls
+// the service once. The instances of the batch are then reconciled again.
+// Nothing is written once the controller is stopped.
+func (r *Reconciler) flushConfig(ctx context.Context, service string, b *batch) {
+	if ctx.Err() != nil {
+		return
+	}
+	ctx = r.configStore.ToContext(ctx)
+	logger := logging.FromContext(ctx).With(zap.String("service", service))
+
+	defer func() {
+		for fn := range b.functions {
+			r.enqueue(fn)
 		}
+	}()
 
-		if _, ok := cm.Data["___config.json"]; !ok {
-			cm.Data["___config.json"] = "{}"
-			update = true
+	cms, err := r.configShards(ctx, service).Update(ctx, b.changes)
+	if err != nil {
+		if !apierrs.IsNotFound(err) {
+			logger.Error("Failed to write the function configuration batch", zap.Error(err))
 		}
+		return
+	}
+
+	// The controller stopped while the configuration was written, for
+	// instance because the kind is being torn down.
+	if ctx.Err() != nil {
+		return
+	}
 
-		// Deserialize config
-		var config map[string]interface{}
-		err = json.Unmarshal([]byte(cm.Data["___config.json"]), &config)
+	ns := config.FromContext(ctx).RuntimeNamespace
+	svc, err := r.serviceLister.Services(ns).Get(service)
+	if err != nil {
+		if !apierrs.IsNotFound(err) {
+			logger.Error("Unable to get the function service", zap.Error(err))
+		}
+		return
+	}
+
+	if _, err = r.reconcileService(ctx, svc, cms); err != nil {
+		logger.Error("Failed to update the function service", zap.Error(err))
+		return
+	}
+	logger.Infow("Wrote function configuration batch", zap.Int("changes", len(b.changes)))
+}
+
+// removeConfig removes the configuration stored under key from the
+// configuration of service, if any.
+func (r *Reconciler) removeConfig(ctx context.Context, service string, key string) ([]*corev1.ConfigMap, error) {
+	logger := logging.FromContext(ctx)
+
+	cms, err := r.configShards(ctx, service).Remove(ctx, key)
+	if err != nil {
+		logger.Error("Unable to remove the function configuration", zap.Error(err))
+		return nil, err
+	}
+	return cms, nil
+}
+
+func (r *Reconciler) configShards(ctx context.Context, service string) *shards.Client {
+	ns := config.FromContext(ctx).RuntimeNamespace
+	return shards.NewClient(r.kubeClient.CoreV1(), r.configMapLister, ns, service)
+}
+
+// configKey returns the key under which the configuration of the function
+// served by the given route is stored. It matches the route host
+// stripped from the cluster domain.
+func configKey(routeName, routeNamespace string) string {
+	return routeName + "." + routeNamespace
+}
+
+// track reconciles fn when the object of kind gvk called namespace/name
+// changes.
+func (r *Reconciler) track(fn *duckv1alpha1.Function, gvk schema.GroupVersionKind, namespace, name string) error {
+	apiVersion, kind := gvk.ToAPIVersionAndKind()
+	return r.Tracker.Track(corev1.ObjectReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  namespace,
+		Name:       name,
+	}, fn)
+}
+
+// checkService returns the Knative service serving fn.
+func (r *Reconciler) checkService(ctx context.Context, fn *duckv1alpha1.Function) (*servingv1beta1.Service, error) {
+	logger := logging.FromContext(ctx)
+
+	ns := config.FromContext(ctx).RuntimeNamespace
+	gr := r.gvr.GroupResource()
+	if err := r.track(fn, serviceGVK, ns, names.ServiceName(gr)); err != nil {
+		return nil, err
+	}
+	service, err := r.serviceLister.Services(ns).Get(names.ServiceName(gr))
+	if err != nil {
+		logger.Error("Unable to get the function service", zap.Error(err))
+		return nil, err
+	}
+
+	// The instances of the kind are spread across several services.
+	if index := resources.ServiceIndex(fn, resources.ServiceCount(service)); index != 0 {
+		if err := r.track(fn, serviceGVK, ns, names.ServiceShardName(gr, index)); err != nil {
+			return nil, err
+		}
+		service, err = r.serviceLister.Services(ns).Get(names.ServiceShardName(gr, index))
 		if err != nil {
-			logger.Error("Unable to deserialize existing configuration", zap.Error(err))
+			logger.Error("Unable to get the function service", zap.Error(err))
 			return nil, err
 		}
+	}
 
-		// Update configuration
-		data := fn.Spec
+	return service, nil
+}
 
-		key := route.Status.Address.URL
-		if key != nil {
-			host := key.Host
-			parts := strings.Split(host, ".")
-			host = parts[0] + "." + parts[1]
-			if old, ok := config[host]; !ok || !equality.Semantic.DeepEqual(old, data) {
-				config[host] = data
-				update = true
-			}
+// reconcileDedicatedService makes sure the Knative service dedicated to fn
+// exists. It runs the same image as the shared service.
+func (r *Reconciler) reconcileDedicatedService(ctx context.Context, fn *duckv1alpha1.Function, shared *servingv1beta1.Service) (*servingv1beta1.Service, error) {
+	logger := logging.FromContext(ctx)
+
+	ns := config.FromContext(ctx).RuntimeNamespace
+	gr := r.gvr.GroupResource()
+	serviceName := names.DedicatedServiceName(gr, fn.Namespace, fn.Name)
+	image := resources.ServiceImage(shared)
+
+	if err := r.track(fn, serviceGVK, ns, serviceName); err != nil {
+		return nil, err
+	}
+	service, err := r.serviceLister.Services(ns).Get(serviceName)
+	if apierrs.IsNotFound(err) {
+		// Use the configuration format of the shared service.
+		sharedcms, err := r.configShards(ctx, shared.Name).Get()
+		if err != nil {
+			logger.Error("Unable to get the function configmap", zap.Error(err))
+			return nil, err
+		}
+
+		cm, err := crdresources.MakeConfigMap(ns, names.ConfigMapName(serviceName), shards.Format(sharedcms[0]))
+		if err != nil {
+			return nil, err
+		}
+		cm, err = r.kubeClient.CoreV1().ConfigMaps(ns).Create(cm)
+		if err != nil && !apierrs.IsAlreadyExists(err) {
+			logger.Error("Failed to create the dedicated function configmap", zap.Error(err))
+			return nil, err
 		}
 
-		if update {
-			rawconfig, err := json.Marshal(config)
+		cms, err := r.configShards(ctx, serviceName).Get()
+		if err != nil {
+			logger.Error("Unable to get the dedicated function configmap", zap.Error(err))
+			return nil, err
+		}
+		cmnames := make([]string, len(cms))
+		for i, cm := range cms {
+			cmnames[i] = cm.Name
+		}
+
+		version := ""
+		if !resources.IsHotReloaded(shared) {
+			version, err = shards.Version(cms)
 			if err != nil {
-				logger.Error("Unable to serialize new configuration", zap.Error(err))
+				logger.Error("Unable to compute the function configuration version", zap.Error(err))
 				return nil, err
 			}
+		}
 
-			cm.Data["___config.json"] = string(rawconfig)
-
-			return r.kubeClient.CoreV1().ConfigMaps(system.Namespace()).Update(cm)
+		service = resources.MakeDedicatedService(ns, gr, fn, cmnames, shards.Format(cms[0]), version, image)
+		service.Annotations[duckv1alpha1.ReloadAnnotation] = shared.Annotations[duckv1alpha1.ReloadAnnotation]
+		service, err = r.servingClient.ServingV1beta1().Services(ns).Create(service)
+		if err != nil {
+			logger.Error("Failed to create the dedicated function service", zap.Error(err))
+			return nil, err
 		}
+		return service, nil
+	} else if err != nil {
+		logger.Error("Unable to get the dedicated function service", zap.Error(err))
+		return nil, err
 	}
 
-	return cm, nil
+	if !resources.IsOwnedBy(service, fn) {
+		return nil, fmt.Errorf("Function: %s/%s does not own Service: %q", fn.Namespace, fn.Name, service.Name)
+	}
+
+	// Follow the image and the reload mode of the shared service.
+	reload := shared.Annotations[duckv1alpha1.ReloadAnnotation]
+	if resources.IsUnmanaged(service) {
+		return service, nil
+	}
+	if (resources.ServiceImage(service) != image || service.Annotations[duckv1alpha1.ReloadAnnotation] != reload) && len(service.Spec.Template.Spec.Containers) > 0 {
+		service = service.DeepCopy()
+		service.Spec.Template.Spec.Containers[0].Image = image
+		if service.Annotations == nil {
+			service.Annotations = make(map[string]string)
+		}
+		service.Annotations[duckv1alpha1.ReloadAnnotation] = reload
+		service, err = r.servingClient.ServingV1beta1().Services(ns).Update(service)
+		if err != nil {
+			logger.Error("Failed to update the dedicated function service", zap.Error(err))
+			return nil, err
+		}
+		r.Recorder.Eventf(fn, corev1.EventTypeNormal, "ServiceUpdated", "Updated dedicated service %s/%s", ns, service.Name)
+	}
+	return service, nil
 }
 
-func (r *Reconciler) checkService(ctx context.Context, functionName string) (*servingv1beta1.Service, error) {
+// deleteDedicatedService deletes the Knative service dedicated to fn and
+// its configmaps, if any.
+func (r *Reconciler) deleteDedicatedService(ctx context.Context, fn *duckv1alpha1.Function) error {
 	logger := logging.FromContext(ctx)
 
-	// Update service annotation with config map UUID.
-	service, err := r.serviceLister.Services("knative-functions").Get(r.functionName)
-	if err != nil {
-		logger.Error("Unable to get the function service", zap.Error(err))
-		return nil, err
+	ns := config.FromContext(ctx).RuntimeNamespace
+	serviceName := names.DedicatedServiceName(r.gvr.GroupResource(), fn.Namespace, fn.Name)
+
+	service, err := r.serviceLister.Services(ns).Get(serviceName)
+	if apierrs.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		logger.Error("Unable to get the dedicated function service", zap.Error(err))
+		return err
+	}
+	if !resources.IsOwnedBy(service, fn) {
+		return nil
 	}
 
-	return service, nil
+	err = r.servingClient.ServingV1beta1().Services(ns).Delete(serviceName, &metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		logger.Error("Failed to delete the dedicated function service", zap.Error(err))
+		return err
+	}
+
+	if _, err := r.configShards(ctx, serviceName).Delete(); err != nil {
+		logger.Error("Failed to delete the dedicated function configmaps", zap.Error(err))
+		return err
+	}
+	return nil
 }
 
 func (r *Reconciler) propagateServiceStatusIfError(ctx context.Context, fn *duckv1alpha1.Function, service *servingv1beta1.Service) error {
 	c := service.Status.GetCondition(servingv1beta1.ServiceConditionReady)
 	if c == nil || c.Status != corev1.ConditionTrue {
 		if c == nil {
-			fn.Status.MarkServiceNotSynced("Unknown", "")
+			fn.Status.MarkServiceNotReady(duckv1alpha1.ReasonStatusUnknown, "")
 		} else {
-			fn.Status.MarkServiceNotSynced(c.Reason, c.Message)
+			fn.Status.MarkServiceNotReady(c.Reason, "%s", c.Message)
 		}
 		return fmt.Errorf("service %s is not ready", service.Name)
 	}
 	return nil
 }
 
-func (r *Reconciler) reconcileService(ctx context.Context, service *servingv1beta1.Service, cm *corev1.ConfigMap) (*servingv1beta1.Service, error) {
+// isStale returns true when the revision template of svc doesn't carry the
+// version of the configuration stored in cms.
+func isStale(svc *servingv1beta1.Service, cms []*corev1.ConfigMap) (bool, error) {
+	expected, err := shards.Version(cms)
+	if err != nil {
+		return false, err
+	}
+	return svc.Spec.Template.Annotations[duckv1alpha1.ConfigMapAnnotation] != expected, nil
+}
+
+func (r *Reconciler) reconcileService(ctx context.Context, service *servingv1beta1.Service, cms []*corev1.ConfigMap) (*servingv1beta1.Service, error) {
 	version := service.Spec.Template.Annotations[duckv1alpha1.ConfigMapAnnotation]
+	expected, err := shards.Version(cms)
+	if err != nil {
+		return nil, err
+	}
 
-	if version != cm.ResourceVersion {
-		copy := service.DeepCopy()
-		copy.Spec.Template.Annotations[duckv1alpha1.ConfigMapAnnotation] = cm.ResourceVersion
+	cmnames := make([]string, len(cms))
+	for i, cm := range cms {
+		cmnames[i] = cm.Name
+	}
+	format := shards.Format(cms[0])
+
+	// Runtimes reloading the configuration files read its version from the
+	// first shard, and keep serving the same revision.
+	hot := resources.IsHotReloaded(service)
+	if hot && cms[0].Data[shards.VersionKey] != expected {
+		if err := r.configShards(ctx, service.Name).SetVersion(ctx, expected); err != nil {
+			return nil, err
+		}
+	}
 
-		return r.servingClient.Serving().Services(service.Namespace).Update(copy)
+	if shards.Projects(service.Spec.Template.Spec.PodSpec, cmnames, format) {
+		if hot || version == expected {
+			return service, nil
+		}
+
+		// Only the configuration version changed.
+		patch, err := makeVersionPatch(expected)
+		if err != nil {
+			return nil, err
+		}
+		return r.servingClient.ServingV1beta1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, patch)
 	}
 
+	// The shards have been split, merged or migrated. Containers can't be
+	// merge patched so the service is updated, retrying on conflicts.
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		copy := service.DeepCopy()
+		if !hot {
+			if copy.Spec.Template.Annotations == nil {
+				copy.Spec.Template.Annotations = make(map[string]string)
+			}
+			copy.Spec.Template.Annotations[duckv1alpha1.ConfigMapAnnotation] = expected
+		}
+
+		if len(copy.Spec.Template.Spec.Containers) > 0 {
+			volume, mounts := shards.Volume(cmnames, format)
+			copy.Spec.Template.Spec.Volumes = []corev1.Volume{volume}
+			copy.Spec.Template.Spec.Containers[0].VolumeMounts = mounts
+		}
+
+		updated, err := r.servingClient.ServingV1beta1().Services(service.Namespace).Update(copy)
+		if apierrs.IsConflict(err) {
+			latest, gerr := r.servingClient.ServingV1beta1().Services(service.Namespace).Get(service.Name, metav1.GetOptions{})
+			if gerr != nil {
+				return gerr
+			}
+			service = latest
+		} else if err == nil {
+			service = updated
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 	return service, nil
 }
 
+// makeVersionPatch returns a merge patch setting the configuration version
+// of a service.
+func makeVersionPatch(version string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						duckv1alpha1.ConfigMapAnnotation: version,
+					},
+				},
+			},
+		},
+	})
+}
+
+// finalize removes the function configuration from the shared runtime and
+// deletes the function route before releasing the finalizer.
+func (r *Reconciler) finalize(ctx context.Context, fn *duckv1alpha1.Function) error {
+	logger := logging.FromContext(ctx)
+
+	if !hasFinalizer(fn) {
+		return nil
+	}
+
+	ns := config.FromContext(ctx).RuntimeNamespace
+	routeName := names.RouteName(r.gvr.GroupResource(), fn.Namespace, fn.Name)
+
+	// The configuration is served by the service receiving the route traffic.
+	service := names.ServiceName(r.gvr.GroupResource())
+	route, err := r.routeLister.Routes(ns).Get(routeName)
+	if err == nil {
+		if resources.IsOwnedBy(route, fn) || resources.IsLegacyOwnedBy(route, fn) {
+			if name := resources.RouteService(route); name != "" {
+				service = name
+			}
+		} else {
+			route = nil
+		}
+	} else if apierrs.IsNotFound(err) {
+		route = nil
+	} else {
+		logger.Error("Unable to get the function route", zap.Error(err))
+		return err
+	}
+
+	key := configKey(routeName, ns)
+	dedicated := service == names.DedicatedServiceName(r.gvr.GroupResource(), fn.Namespace, fn.Name)
+
+	// Wait for the removal of the configuration to be written with the
+	// batch before deleting the route.
+	if window := config.FromContext(ctx).ConfigBatchWindow; window > 0 && !dedicated {
+		cms, err := r.configShards(ctx, service).Get()
+		if err != nil && !apierrs.IsNotFound(err) {
+			logger.Error("Unable to get the function configmap", zap.Error(err))
+			return err
+		}
+		if err == nil {
+			_, ok, err := shards.Value(cms, key)
+			if err != nil {
+				logger.Error("Unable to read the function configuration", zap.Error(err))
+				return err
+			}
+			if ok {
+				r.batcher.add(service, key, nil, types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name}, window)
+				return nil
+			}
+		}
+	}
+
+	cms, err := r.removeConfig(ctx, service, key)
+	if err != nil {
+		return err
+	}
+
+	if route != nil {
+		err = r.servingClient.ServingV1beta1().Routes(ns).Delete(routeName, &metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			logger.Error("Failed to delete the function route", zap.Error(err))
+			return err
+		}
+	}
+
+	if dedicated {
+		if err := r.deleteDedicatedService(ctx, fn); err != nil {
+			return err
+		}
+	} else if cms != nil && config.FromContext(ctx).ConfigBatchWindow == 0 {
+		svc, err := r.serviceLister.Services(ns).Get(service)
+		if err == nil {
+			if _, err = r.reconcileService(ctx, svc, cms); err != nil {
+				logger.Error("Failed to update the function service", zap.Error(err))
+				return err
+			}
+		} else if !apierrs.IsNotFound(err) {
+			logger.Error("Unable to get the function service", zap.Error(err))
+			return err
+		}
+	}
+
+	return r.removeFinalizer(fn)
+}
+
+func hasFinalizer(fn *duckv1alpha1.Function) bool {
+	for _, f := range fn.Finalizers {
+		if f == duckv1alpha1.FunctionFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reconciler) addFinalizer(fn *duckv1alpha1.Function) error {
+	if hasFinalizer(fn) {
+		return nil
+	}
+	return r.patchFinalizers(fn, append(fn.Finalizers, duckv1alpha1.FunctionFinalizer))
+}
+
+func (r *Reconciler) removeFinalizer(fn *duckv1alpha1.Function) error {
+	finalizers := []string{}
+	for _, f := range fn.Finalizers {
+		if f != duckv1alpha1.FunctionFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	return r.patchFinalizers(fn, finalizers)
+}
+
+// patchFinalizers replaces the function finalizers, failing if the function
+// changed since it was read.
+func (r *Reconciler) patchFinalizers(fn *duckv1alpha1.Function, finalizers []string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": fn.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	patched, err := r.dynamicClient.Namespace(fn.Namespace).Patch(fn.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+
+	fn.Finalizers = finalizers
+	fn.ResourceVersion = patched.GetResourceVersion()
+	return nil
+}
+
 // Update the Status of the resource.  Caller is responsible for checking
 // for semantic differences before calling.
 func (r *Reconciler) updateStatus(desired *duckv1alpha1.Function) (*unstructured.Unstructured, error) {
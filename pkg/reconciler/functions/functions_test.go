@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/apis/duck"
+	"knative.dev/pkg/tracker"
+	servingv1beta1listers "knative.dev/serving/pkg/client/listers/serving/v1beta1"
+
+	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/config"
+)
+
+const (
+	testNamespace        = "default"
+	testRuntimeNamespace = "knative-functions"
+)
+
+var testGVR = schema.GroupVersionResource{Group: "functions.knative.dev", Version: "v1alpha1", Resource: "filters"}
+
+func TestReconcileNewFunction(t *testing.T) {
+	object := makeFunction("my-filter")
+	r := newReconciler(object)
+	fn := toFunction(t, object)
+
+	// The function runtime does not exist yet.
+	err := r.reconcile(testContext(), fn)
+	if !apierrs.IsNotFound(err) {
+		t.Fatalf("reconcile() = %v, want a not found error", err)
+	}
+
+	if !hasFinalizer(fn) {
+		t.Errorf("finalizers = %v, want %s", fn.Finalizers, duckv1alpha1.FunctionFinalizer)
+	}
+	if _, ok := r.specChanges.served(fn); !ok {
+		t.Error("the spec change of the new function was not observed")
+	}
+}
+
+func TestReconcileDeletedFunction(t *testing.T) {
+	object := makeFunction("my-filter")
+	r := newReconciler(object)
+	fn := toFunction(t, object)
+	r.specChanges.observe(fn)
+
+	now := metav1.Now()
+	fn.DeletionTimestamp = &now
+	if err := r.reconcile(testContext(), fn); err != nil {
+		t.Fatalf("reconcile() = %v", err)
+	}
+
+	if _, ok := r.specChanges.served(fn); ok {
+		t.Error("the spec change of the deleted function was not forgotten")
+	}
+}
+
+func newReconciler(objects ...runtime.Object) *Reconciler {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	return &Reconciler{
+		dynamicClient:  dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...).Resource(testGVR),
+		routeLister:    servingv1beta1listers.NewRouteLister(indexer),
+		serviceLister:  servingv1beta1listers.NewServiceLister(indexer),
+		revisionLister: servingv1beta1listers.NewRevisionLister(indexer),
+		Tracker:        tracker.New(func(types.NamespacedName) {}, time.Minute),
+		Recorder:       record.NewFakeRecorder(10),
+		gvr:            testGVR,
+		specChanges:    newSpecChanges(),
+	}
+}
+
+func testContext() context.Context {
+	return config.ToContext(context.Background(), &config.Config{
+		RuntimeNamespace: testRuntimeNamespace,
+	})
+}
+
+func makeFunction(name string) *unstructured.Unstructured {
+	object := &unstructured.Unstructured{}
+	object.SetAPIVersion(testGVR.GroupVersion().String())
+	object.SetKind("Filter")
+	object.SetNamespace(testNamespace)
+	object.SetName(name)
+	object.SetGeneration(1)
+	return object
+}
+
+func toFunction(t *testing.T, object *unstructured.Unstructured) *duckv1alpha1.Function {
+	t.Helper()
+	fn := &duckv1alpha1.Function{}
+	if err := duck.FromUnstructured(object, fn); err != nil {
+		t.Fatalf("FromUnstructured() = %v", err)
+	}
+	return fn
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"knative.dev/serving/pkg/apis/networking"
+	"knative.dev/serving/pkg/apis/serving"
+	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
+)
+
+const (
+	// ConfigVersionPath is the path where runtimes reloading the
+	// configuration files serve the version of the configuration they
+	// loaded, read from the shards.VersionKey file.
+	ConfigVersionPath = "/.well-known/functions/config-version"
+
+	// reloadProbeTimeout is the timeout of the requests to ConfigVersionPath.
+	reloadProbeTimeout = 2 * time.Second
+
+	// reloadProbeInterval is the delay before probing a runtime again while
+	// it has not loaded the latest configuration.
+	reloadProbeInterval = 5 * time.Second
+
+	// maxConfigVersionSize bounds the size of the responses to ConfigVersionPath.
+	maxConfigVersionSize = 1024
+)
+
+// probeConfigVersion returns true when all ready pods of the latest ready
+// revision of svc have loaded the configuration version. It returns true
+// without probing when the revision has no ready pods, so that services
+// scaled to zero are not woken up: their pods load the latest configuration
+// when they start.
+func (r *Reconciler) probeConfigVersion(ctx context.Context, svc *servingv1beta1.Service, version string) (bool, error) {
+	revision := svc.Status.LatestReadyRevisionName
+	if revision == "" {
+		return false, fmt.Errorf("service %s has no ready revision", svc.Name)
+	}
+
+	// The private service of a revision selects its ready pods.
+	endpoints, err := r.endpointsLister.Endpoints(svc.Namespace).List(labels.SelectorFromSet(labels.Set{
+		serving.RevisionLabelKey:  revision,
+		networking.ServiceTypeKey: string(networking.ServiceTypePrivate),
+	}))
+	if err != nil {
+		return false, err
+	}
+
+	for _, ep := range endpoints {
+		for _, subset := range ep.Subsets {
+			port := probePort(subset)
+			for _, address := range subset.Addresses {
+				loaded, err := r.probe(ctx, net.JoinHostPort(address.IP, strconv.Itoa(port)))
+				if err != nil {
+					return false, err
+				}
+				if loaded != version {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+// probePort returns the HTTP port of the pods of subset.
+func probePort(subset corev1.EndpointSubset) int {
+	for _, port := range subset.Ports {
+		if port.Name == networking.ServicePortNameHTTP1 {
+			return int(port.Port)
+		}
+	}
+	return networking.BackendHTTPPort
+}
+
+// probe returns the version of the configuration loaded by the pod at host.
+func (r *Reconciler) probe(ctx context.Context, host string) (string, error) {
+	target := url.URL{Scheme: "http", Host: host, Path: ConfigVersionPath}
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reloadProbeTimeout)
+	defer cancel()
+
+	resp, err := r.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigVersionSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pod %s answered %s to the configuration version probe", host, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
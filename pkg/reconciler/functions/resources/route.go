@@ -17,13 +17,13 @@ limitations under the License.
 package resources
 
 import (
-	"fmt"
-
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"knative.dev/pkg/kmeta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
 
 	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
 )
 
 const (
@@ -31,41 +31,162 @@ const (
 	portNumber        = 80
 	FunctionRoleLabel = "functions.knative.dev/role"
 	FunctionRole      = "dispatcher"
+
+	// Routes live in a different namespace than the functions they serve
+	// so ownership is tracked with labels and annotations rather than
+	// with owner references.
+	FunctionKindLabel      = "functions.knative.dev/kind"
+	FunctionRuntimeLabel   = "functions.knative.dev/runtime"
+	FunctionNamespaceLabel = "functions.knative.dev/namespace"
+	FunctionUIDLabel       = "functions.knative.dev/uid"
+	FunctionNameAnnotation = "functions.knative.dev/name"
 )
 
 // RouteOption can be used to optionally modify the Route in MakeRoute.
 type RouteOption func(*servingv1beta1.Route) error
 
-func MakeRouteName(functionName, name, ns string) string {
-	return fmt.Sprintf("%s-%s-%s", functionName, ns, name)
+// MakeOwnerLabels returns the labels identifying the function owning a route.
+func MakeOwnerLabels(gr schema.GroupResource, fn *duckv1alpha1.Function) map[string]string {
+	labels := map[string]string{
+		FunctionRoleLabel:    FunctionRole,
+		FunctionKindLabel:    fn.Kind,
+		FunctionRuntimeLabel: names.ServiceName(gr),
+		FunctionUIDLabel:     string(fn.UID),
+	}
+
+	// Cluster-scoped functions do not have a namespace
+	if fn.Namespace != "" {
+		labels[FunctionNamespaceLabel] = fn.Namespace
+	}
+	return labels
 }
 
-func MakeRoute(functionName string, fn *duckv1alpha1.Function, opts ...RouteOption) (*servingv1beta1.Route, error) {
-	// Add annotations
-	tr := true
+// MakeOwnerAnnotations returns the annotations identifying the function owning a route.
+func MakeOwnerAnnotations(fn *duckv1alpha1.Function) map[string]string {
+	return map[string]string{
+		FunctionNameAnnotation: fn.Name,
+	}
+}
+
+// IsOwnedBy returns true when the route, or the dedicated service, is owned by the function.
+func IsOwnedBy(obj metav1.Object, fn *duckv1alpha1.Function) bool {
+	uid, ok := obj.GetLabels()[FunctionUIDLabel]
+	return ok && uid == string(fn.UID)
+}
+
+// IsLegacyOwnedBy returns true when the route is owned by the function
+// through an owner reference, as done by previous versions of this controller.
+func IsLegacyOwnedBy(route *servingv1beta1.Route, fn *duckv1alpha1.Function) bool {
+	_, ok := route.Labels[FunctionUIDLabel]
+	return !ok && metav1.IsControlledBy(route, fn)
+}
+
+// IsUnmanaged returns true when the controller must leave the changes made
+// to obj in place.
+func IsUnmanaged(obj metav1.Object) bool {
+	return obj.GetAnnotations()[duckv1alpha1.UnmanagedAnnotation] == "true"
+}
+
+// SyncRoute returns a copy of route where the ownership labels, annotations
+// and traffic targets are reverted to expected, and whether any of them
+// drifted.
+func SyncRoute(route, expected *servingv1beta1.Route) (*servingv1beta1.Route, bool) {
+	drifted := false
+	route = route.DeepCopy()
+
+	if route.Labels == nil {
+		route.Labels = make(map[string]string)
+	}
+	for k, v := range expected.Labels {
+		if route.Labels[k] != v {
+			route.Labels[k] = v
+			drifted = true
+		}
+	}
+
+	if route.Annotations == nil {
+		route.Annotations = make(map[string]string)
+	}
+	for k, v := range expected.Annotations {
+		if route.Annotations[k] != v {
+			route.Annotations[k] = v
+			drifted = true
+		}
+	}
+
+	if !equality.Semantic.DeepEqual(route.Spec.Traffic, expected.Spec.Traffic) {
+		route.Spec.Traffic = expected.Spec.Traffic
+		drifted = true
+	}
+	return route, drifted
+}
+
+// NeedsMigration returns true when the route is owned by the function but
+// its ownership labels and annotations are missing or outdated.
+func NeedsMigration(route *servingv1beta1.Route, gr schema.GroupResource, fn *duckv1alpha1.Function) bool {
+	if IsLegacyOwnedBy(route, fn) {
+		return true
+	}
+	if !IsOwnedBy(route, fn) {
+		return false
+	}
+	for k, v := range MakeOwnerLabels(gr, fn) {
+		if route.Labels[k] != v {
+			return true
+		}
+	}
+	for k, v := range MakeOwnerAnnotations(fn) {
+		if route.Annotations[k] != v {
+			return true
+		}
+	}
+	return false
+}
+
+// MigrateRoute replaces the owner reference to fn with ownership labels and annotations.
+func MigrateRoute(route *servingv1beta1.Route, gr schema.GroupResource, fn *duckv1alpha1.Function) *servingv1beta1.Route {
+	route = route.DeepCopy()
+
+	refs := []metav1.OwnerReference{}
+	for _, ref := range route.OwnerReferences {
+		if ref.UID != fn.UID {
+			refs = append(refs, ref)
+		}
+	}
+	route.OwnerReferences = refs
+
+	if route.Labels == nil {
+		route.Labels = make(map[string]string)
+	}
+	for k, v := range MakeOwnerLabels(gr, fn) {
+		route.Labels[k] = v
+	}
+
+	if route.Annotations == nil {
+		route.Annotations = make(map[string]string)
+	}
+	for k, v := range MakeOwnerAnnotations(fn) {
+		route.Annotations[k] = v
+	}
+	return route
+}
+
+// MakeRoute creates the route of fn, sending traffic to the Knative service
+// called service.
+func MakeRoute(namespace string, gr schema.GroupResource, fn *duckv1alpha1.Function, service string, opts ...RouteOption) (*servingv1beta1.Route, error) {
 	route := &servingv1beta1.Route{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "v1beta1",
 			Kind:       "Route",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      MakeRouteName(functionName, fn.Name, fn.Namespace),
-			Namespace: "knative-functions",
-			Labels: map[string]string{
-				FunctionRoleLabel: FunctionRole,
-			},
-			OwnerReferences: []metav1.OwnerReference{
-				*kmeta.NewControllerRef(fn),
-			},
+			Name:        names.RouteName(gr, fn.Namespace, fn.Name),
+			Namespace:   namespace,
+			Labels:      MakeOwnerLabels(gr, fn),
+			Annotations: MakeOwnerAnnotations(fn),
 		},
 		Spec: servingv1beta1.RouteSpec{
-			Traffic: []servingv1beta1.TrafficTarget{
-				{
-					ConfigurationName: functionName,
-					LatestRevision:    &tr,
-					Percent:           100,
-				},
-			},
+			Traffic: MakeTraffic(service),
 		},
 	}
 	for _, opt := range opts {
@@ -75,3 +196,27 @@ func MakeRoute(functionName string, fn *duckv1alpha1.Function, opts ...RouteOpti
 	}
 	return route, nil
 }
+
+// MakeTraffic returns the traffic targets sending all traffic to the latest
+// revision of the Knative service called service.
+func MakeTraffic(service string) []servingv1beta1.TrafficTarget {
+	tr := true
+	return []servingv1beta1.TrafficTarget{
+		{
+			ConfigurationName: service,
+			LatestRevision:    &tr,
+			Percent:           100,
+		},
+	}
+}
+
+// RouteService returns the name of the Knative service receiving the
+// traffic of the route, or the empty string.
+func RouteService(route *servingv1beta1.Route) string {
+	for _, target := range route.Spec.Traffic {
+		if target.ConfigurationName != "" {
+			return target.ConfigurationName
+		}
+	}
+	return ""
+}
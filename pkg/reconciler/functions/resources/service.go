@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resources
+
+import (
+	"hash/fnv"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
+
+	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+	crdresources "github.com/lionelvillard/knative-functions-controller/pkg/reconciler/crds/resources"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
+)
+
+// ServiceCount returns the number of Knative services serving the instances
+// of a function kind, as recorded on the first service.
+func ServiceCount(service *servingv1beta1.Service) int {
+	count, err := strconv.Atoi(service.Annotations[duckv1alpha1.ServiceCountAnnotation])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// ServiceIndex returns the index of the Knative service serving fn among
+// count services. It uses jump consistent hashing, so that only about 1/count
+// of the instances move to another service when a service is added.
+func ServiceIndex(fn *duckv1alpha1.Function, count int) int {
+	h := fnv.New64a()
+	h.Write([]byte(fn.Namespace + "/" + fn.Name))
+	return jumpHash(h.Sum64(), count)
+}
+
+// jumpHash maps key to a bucket among count, as described in "A Fast,
+// Minimal Memory, Consistent Hash Algorithm" by Lamping and Veach.
+func jumpHash(key uint64, count int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(count) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// IsDedicated returns true when fn requests a dedicated Knative service.
+func IsDedicated(fn *duckv1alpha1.Function) bool {
+	return fn.Annotations[duckv1alpha1.IsolationAnnotation] == duckv1alpha1.DedicatedIsolation
+}
+
+// ServiceImage returns the image run by the Knative service.
+func ServiceImage(service *servingv1beta1.Service) string {
+	if len(service.Spec.Template.Spec.Containers) == 0 {
+		return ""
+	}
+	return service.Spec.Template.Spec.Containers[0].Image
+}
+
+// MakeDedicatedService creates the Knative service dedicated to fn. The
+// service runs image and projects the configuration shards called
+// configMapNames, stored in format.
+func MakeDedicatedService(namespace string, gr schema.GroupResource, fn *duckv1alpha1.Function, configMapNames []string, format, version, image string) *servingv1beta1.Service {
+	service := crdresources.MakeKnativeService(namespace, names.DedicatedServiceName(gr, fn.Namespace, fn.Name), configMapNames, format, version, image)
+
+	service.Labels = MakeOwnerLabels(gr, fn)
+	delete(service.Labels, FunctionRoleLabel)
+	service.Annotations = MakeOwnerAnnotations(fn)
+	return service
+}
+
+// IsHotReloaded returns true when the runtime served by svc reloads the
+// configuration changes without a new revision.
+func IsHotReloaded(svc *servingv1beta1.Service) bool {
+	return svc.Annotations[duckv1alpha1.ReloadAnnotation] == duckv1alpha1.HotReload
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resources
+
+import (
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+)
+
+func TestServiceIndexMoves(t *testing.T) {
+	const instances = 10000
+
+	for count := 1; count < 8; count++ {
+		moved := 0
+		for i := 0; i < instances; i++ {
+			fn := &duckv1alpha1.Function{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("fn-%d", i)},
+			}
+			before, after := ServiceIndex(fn, count), ServiceIndex(fn, count+1)
+			if after < 0 || after > count {
+				t.Fatalf("ServiceIndex(%s, %d) = %d, want an index below %d", fn.Name, count+1, after, count+1)
+			}
+			if before != after {
+				if after != count {
+					t.Fatalf("instance %s moved from service %d to %d, want it to move to the new service %d", fn.Name, before, after, count)
+				}
+				moved++
+			}
+		}
+
+		// About 1/(count+1) of the instances move to the new service.
+		want := instances / (count + 1)
+		if moved < want*8/10 || moved > want*12/10 {
+			t.Errorf("%d instances moved when adding service %d, want about %d", moved, count, want)
+		}
+	}
+}
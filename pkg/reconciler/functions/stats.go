@@ -0,0 +1,285 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/apis/duck"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/metrics"
+	"knative.dev/serving/pkg/apis/serving"
+	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
+	servingv1beta1listers "knative.dev/serving/pkg/client/listers/serving/v1beta1"
+
+	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+)
+
+var (
+	reconcileCountStat      = stats.Int64("function_reconcile_count", "Number of function instance reconciles", stats.UnitNone)
+	reconcileLatencyStat    = stats.Int64("function_reconcile_latency", "Latency of function instance reconciles", stats.UnitMilliseconds)
+	instanceCountStat       = stats.Int64("function_instance_count", "Number of function instances", stats.UnitNone)
+	revisionCountStat       = stats.Int64("function_revision_count", "Number of function runtime revisions created", stats.UnitNone)
+	configServedLatencyStat = stats.Int64("function_config_served_latency", "Time from a function instance spec change to its configuration being served", stats.UnitMilliseconds)
+
+	// reconcileDistribution defines the bucket boundaries of the reconcile
+	// latency: 10ms, 100ms, 1s, 10s, 30s and 60s.
+	reconcileDistribution = view.Distribution(10, 100, 1000, 10000, 30000, 60000)
+
+	// configServedDistribution defines the bucket boundaries of the time
+	// until a configuration is served, which includes rolling out a
+	// revision: 1s, 5s, 10s, 30s, 1m, 2m, 5m and 10m.
+	configServedDistribution = view.Distribution(1000, 5000, 10000, 30000, 60000, 120000, 300000, 600000)
+
+	// kindTagKey is the function kind, the group resource of its CRD.
+	kindTagKey      = tag.MustNewKey("kind")
+	resultTagKey    = tag.MustNewKey("result")
+	namespaceTagKey = tag.MustNewKey("namespace_name")
+	readyTagKey     = tag.MustNewKey("ready")
+)
+
+func init() {
+	err := view.Register(&view.View{
+		Description: reconcileCountStat.Description(),
+		Measure:     reconcileCountStat,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{kindTagKey, resultTagKey},
+	}, &view.View{
+		Description: reconcileLatencyStat.Description(),
+		Measure:     reconcileLatencyStat,
+		Aggregation: reconcileDistribution,
+		TagKeys:     []tag.Key{kindTagKey, resultTagKey},
+	}, &view.View{
+		Description: instanceCountStat.Description(),
+		Measure:     instanceCountStat,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{kindTagKey, namespaceTagKey, readyTagKey},
+	}, &view.View{
+		Description: revisionCountStat.Description(),
+		Measure:     revisionCountStat,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{kindTagKey},
+	}, &view.View{
+		Description: configServedLatencyStat.Description(),
+		Measure:     configServedLatencyStat,
+		Aggregation: configServedDistribution,
+		TagKeys:     []tag.Key{kindTagKey},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// reportReconcile records the count and the latency of a reconcile of an
+// instance of the function kind, which returned err.
+func reportReconcile(ctx context.Context, kind string, latency time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	ctx, terr := tag.New(ctx, tag.Insert(kindTagKey, kind), tag.Insert(resultTagKey, result))
+	if terr != nil {
+		logging.FromContext(ctx).Errorw("Failed to tag the reconcile", zap.Error(terr))
+		return
+	}
+	metrics.Record(ctx, reconcileCountStat.M(1))
+	metrics.Record(ctx, reconcileLatencyStat.M(int64(latency/time.Millisecond)))
+}
+
+// reportInstanceCount records the number of instances of the function kind
+// in namespace which are ready, or not.
+func reportInstanceCount(ctx context.Context, kind, namespace string, ready bool, count int) {
+	ctx, err := tag.New(ctx, tag.Insert(kindTagKey, kind), tag.Insert(namespaceTagKey, namespace),
+		tag.Insert(readyTagKey, strconv.FormatBool(ready)))
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Failed to tag the instance count", zap.Error(err))
+		return
+	}
+	metrics.Record(ctx, instanceCountStat.M(int64(count)))
+}
+
+// reportRevisionCreated records the creation of a revision of a runtime of
+// the function kind.
+func reportRevisionCreated(ctx context.Context, kind string) {
+	ctx, err := tag.New(ctx, tag.Insert(kindTagKey, kind))
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Failed to tag the revision count", zap.Error(err))
+		return
+	}
+	metrics.Record(ctx, revisionCountStat.M(1))
+}
+
+// reportConfigServed records the time from a spec change of an instance of
+// the function kind to its configuration being served.
+func reportConfigServed(ctx context.Context, kind string, latency time.Duration) {
+	ctx, err := tag.New(ctx, tag.Insert(kindTagKey, kind))
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Failed to tag the configuration served latency", zap.Error(err))
+		return
+	}
+	metrics.Record(ctx, configServedLatencyStat.M(int64(latency/time.Millisecond)))
+}
+
+// instanceReportInterval is the interval at which the number of instances
+// is reported.
+const instanceReportInterval = 30 * time.Second
+
+// specChanges records when the spec of the instances last changed, to report
+// the time until their configuration is served.
+type specChanges struct {
+	mu      sync.Mutex
+	changes map[types.NamespacedName]specChange
+}
+
+type specChange struct {
+	generation int64
+	time       time.Time
+}
+
+func newSpecChanges() *specChanges {
+	return &specChanges{
+		changes: make(map[types.NamespacedName]specChange),
+	}
+}
+
+// observe records the time of the spec change of fn, unless its
+// configuration is already served or its generation already observed.
+func (s *specChanges) observe(fn *duckv1alpha1.Function) {
+	served := fn.Status.GetCondition(duckv1alpha1.FunctionConditionConfigServed)
+	if fn.Status.ObservedGeneration == fn.Generation && served.IsTrue() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name}
+	if change, ok := s.changes[key]; ok && change.generation == fn.Generation {
+		return
+	}
+	s.changes[key] = specChange{generation: fn.Generation, time: time.Now()}
+}
+
+// served returns the time since the spec change of fn, and forgets it. It
+// returns false when the change of the current generation of fn has not
+// been observed.
+func (s *specChanges) served(fn *duckv1alpha1.Function) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name}
+	change, ok := s.changes[key]
+	if !ok || change.generation != fn.Generation {
+		return 0, false
+	}
+	delete(s.changes, key)
+	return time.Since(change.time), true
+}
+
+// forget forgets the spec change of fn.
+func (s *specChanges) forget(fn *duckv1alpha1.Function) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.changes, types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name})
+}
+
+// reportInstances reports the number of instances of the function kind
+// listed by informer, by namespace and readiness, until ctx is done.
+func reportInstances(ctx context.Context, kind string, informer cache.SharedIndexInformer) {
+	type counter struct {
+		namespace string
+		ready     bool
+	}
+	reported := make(map[counter]int)
+
+	ticker := time.NewTicker(instanceReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// The kind is no longer reconciled.
+			for c := range reported {
+				reportInstanceCount(ctx, kind, c.namespace, c.ready, 0)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		if !informer.HasSynced() {
+			continue
+		}
+		counts := make(map[counter]int)
+		for c := range reported {
+			// Report the namespaces without instances left.
+			counts[c] = 0
+		}
+		for _, obj := range informer.GetStore().List() {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			fn := &duckv1alpha1.Function{}
+			if err := duck.FromUnstructured(u, fn); err != nil {
+				continue
+			}
+			counts[counter{namespace: fn.Namespace, ready: fn.Status.IsReady()}]++
+		}
+
+		reported = make(map[counter]int)
+		for c, count := range counts {
+			reportInstanceCount(ctx, kind, c.namespace, c.ready, count)
+			if count > 0 {
+				reported[c] = count
+			}
+		}
+	}
+}
+
+// reportRevisions returns a handler of the revision informer reporting the
+// revisions created for the services of the function kind gr, including
+// their first revision. The revisions created before the handler, notified
+// when it is added, are not reported again.
+func reportRevisions(ctx context.Context, gr schema.GroupResource, serviceLister servingv1beta1listers.ServiceLister) cache.ResourceEventHandler {
+	// Creation timestamps are truncated to the second.
+	since := time.Now().Truncate(time.Second)
+	runtime := runtimeOf(gr)
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			revision, ok := obj.(*servingv1beta1.Revision)
+			if !ok || revision.CreationTimestamp.Time.Before(since) {
+				return
+			}
+			svc, err := serviceLister.Services(revision.Namespace).Get(revision.Labels[serving.ServiceLabelKey])
+			if err != nil || !runtime(svc) {
+				return
+			}
+			reportRevisionCreated(ctx, gr.String())
+		},
+	}
+}
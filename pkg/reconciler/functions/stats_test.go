@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/serving/pkg/apis/serving"
+	servingv1beta1 "knative.dev/serving/pkg/apis/serving/v1beta1"
+	servingv1beta1listers "knative.dev/serving/pkg/client/listers/serving/v1beta1"
+
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/functions/resources"
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
+)
+
+func TestReportRevisions(t *testing.T) {
+	gr := testGVR.GroupResource()
+	runtime := names.ServiceName(gr)
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(makeService(runtime, runtime))
+	indexer.Add(makeService("other", "other"))
+	handler := reportRevisions(context.Background(), gr, servingv1beta1listers.NewServiceLister(indexer))
+
+	before := countData(t, "function_revision_count", gr.String())
+
+	// The first revision of the runtime is reported.
+	handler.OnAdd(makeRevision(runtime+"-00001", runtime, time.Now()))
+	// Revisions created before the handler are not reported again.
+	handler.OnAdd(makeRevision(runtime+"-00000", runtime, time.Now().Add(-time.Hour)))
+	// Neither are the revisions of other services.
+	handler.OnAdd(makeRevision("other-00001", "other", time.Now()))
+
+	if got, want := countData(t, "function_revision_count", gr.String())-before, int64(1); got != want {
+		t.Errorf("function_revision_count increased by %d, want %d", got, want)
+	}
+}
+
+func TestReportConfigServed(t *testing.T) {
+	object := makeFunction("my-filter")
+	r := newReconciler(object)
+	fn := toFunction(t, object)
+	svc := makeService(names.ServiceName(testGVR.GroupResource()), names.ServiceName(testGVR.GroupResource()))
+	kind := testGVR.GroupResource().String()
+
+	// The spec changed 3 seconds ago.
+	r.specChanges.changes[types.NamespacedName{Namespace: fn.Namespace, Name: fn.Name}] = specChange{
+		generation: fn.Generation,
+		time:       time.Now().Add(-3 * time.Second),
+	}
+	before := distributionData(t, "function_config_served_latency", kind)
+
+	r.markConfigServed(testContext(), fn, svc, "rev-1", "v1", "i1")
+	// The configuration is already served.
+	r.markConfigServed(testContext(), fn, svc, "rev-1", "v1", "i1")
+
+	after := distributionData(t, "function_config_served_latency", kind)
+	if got, want := after.Count-before.Count, int64(1); got != want {
+		t.Fatalf("function_config_served_latency recorded %d values, want %d", got, want)
+	}
+	if after.Max < 3000 || after.Max > 60000 {
+		t.Errorf("function_config_served_latency = %vms, want about 3000ms", after.Max)
+	}
+}
+
+// countData returns the count recorded by the view called name for kind.
+func countData(t *testing.T, name, kind string) int64 {
+	t.Helper()
+	if data, ok := viewData(t, name, kind).(*view.CountData); ok {
+		return data.Value
+	}
+	return 0
+}
+
+// distributionData returns the distribution recorded by the view called name
+// for kind.
+func distributionData(t *testing.T, name, kind string) view.DistributionData {
+	t.Helper()
+	if data, ok := viewData(t, name, kind).(*view.DistributionData); ok {
+		return *data
+	}
+	return view.DistributionData{}
+}
+
+func viewData(t *testing.T, name, kind string) view.AggregationData {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("RetrieveData(%s) = %v", name, err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key == kindTagKey && tag.Value == kind {
+				return row.Data
+			}
+		}
+	}
+	return nil
+}
+
+func makeService(name, runtime string) *servingv1beta1.Service {
+	return &servingv1beta1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testRuntimeNamespace,
+			Name:      name,
+			Labels:    map[string]string{resources.FunctionRuntimeLabel: runtime},
+		},
+	}
+}
+
+func makeRevision(name, service string, created time.Time) *servingv1beta1.Revision {
+	return &servingv1beta1.Revision{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         testRuntimeNamespace,
+			Name:              name,
+			Labels:            map[string]string{serving.ServiceLabelKey: service},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+	}
+}
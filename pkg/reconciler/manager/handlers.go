@@ -0,0 +1,133 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// handlersKey is the context key of the handlers of a Manager.
+type handlersKey struct{}
+
+// handlers dispatches the events of shared informers to the handlers of
+// the running controllers. Handlers can't be removed from shared informers,
+// so a single handler is added to each informer.
+type handlers struct {
+	lock     sync.Mutex
+	handlers map[cache.SharedInformer]map[*registration]struct{}
+}
+
+// registration is a handler added with AddEventHandler.
+type registration struct {
+	handler cache.ResourceEventHandler
+
+	// replayed holds the objects the handler was notified of when added,
+	// by key. The informer may notify their addition afterwards.
+	replayed map[string]interface{}
+}
+
+func newHandlers() *handlers {
+	return &handlers{
+		handlers: make(map[cache.SharedInformer]map[*registration]struct{}),
+	}
+}
+
+// AddEventHandler adds handler to the shared informer until ctx is done.
+// Within a controller started by a Manager, ctx is done when the controller
+// stops. Otherwise handler is added to the informer for good.
+//
+// As with informer.AddEventHandler, handler is first notified of the objects
+// already known by the informer.
+func AddEventHandler(ctx context.Context, informer cache.SharedInformer, handler cache.ResourceEventHandler) {
+	h, ok := ctx.Value(handlersKey{}).(*handlers)
+	if !ok {
+		informer.AddEventHandler(handler)
+		return
+	}
+
+	r := &registration{
+		handler:  handler,
+		replayed: make(map[string]interface{}),
+	}
+
+	h.lock.Lock()
+	registered, ok := h.handlers[informer]
+	if !ok {
+		registered = make(map[*registration]struct{})
+		h.handlers[informer] = registered
+		informer.AddEventHandler(h.dispatcher(informer))
+	}
+	objs := informer.GetStore().List()
+	for _, obj := range objs {
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			r.replayed[key] = obj
+		}
+	}
+	registered[r] = struct{}{}
+	h.lock.Unlock()
+
+	for _, obj := range objs {
+		handler.OnAdd(obj)
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(registered, r)
+	}()
+}
+
+// dispatcher returns the handler added to informer.
+func (h *handlers) dispatcher(informer cache.SharedInformer) cache.ResourceEventHandler {
+	// dispatch calls f with the handlers to notify of the event on obj.
+	dispatch := func(obj interface{}, added bool, f func(cache.ResourceEventHandler)) {
+		key, _ := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+
+		h.lock.Lock()
+		notified := make([]cache.ResourceEventHandler, 0, len(h.handlers[informer]))
+		for r := range h.handlers[informer] {
+			replayed, ok := r.replayed[key]
+			delete(r.replayed, key)
+			// The handler was already notified of this addition.
+			if added && ok && replayed == obj {
+				continue
+			}
+			notified = append(notified, r.handler)
+		}
+		h.lock.Unlock()
+
+		for _, handler := range notified {
+			f(handler)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			dispatch(obj, true, func(handler cache.ResourceEventHandler) { handler.OnAdd(obj) })
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			dispatch(newObj, false, func(handler cache.ResourceEventHandler) { handler.OnUpdate(oldObj, newObj) })
+		},
+		DeleteFunc: func(obj interface{}) {
+			dispatch(obj, false, func(handler cache.ResourceEventHandler) { handler.OnDelete(obj) })
+		},
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestAddEventHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watcher := watch.NewFake()
+	informer := cache.NewSharedInformer(&cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &corev1.ConfigMapList{Items: []corev1.ConfigMap{*makeConfigMap("known")}}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	}, &corev1.ConfigMap{}, 0)
+	go informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		t.Fatal("the informer did not sync")
+	}
+
+	managerCtx := context.WithValue(ctx, handlersKey{}, newHandlers())
+	firstCtx, stopFirst := context.WithCancel(managerCtx)
+	first := make(chan string, 10)
+	AddEventHandler(firstCtx, informer, notify(first))
+	second := make(chan string, 10)
+	AddEventHandler(managerCtx, informer, notify(second))
+
+	// Both handlers are notified of the known objects.
+	expect(t, first, "known")
+	expect(t, second, "known")
+
+	watcher.Add(makeConfigMap("added"))
+	expect(t, first, "added")
+	expect(t, second, "added")
+
+	// The handler of a stopped controller is removed.
+	stopFirst()
+	time.Sleep(100 * time.Millisecond)
+	watcher.Add(makeConfigMap("added-after-stop"))
+	expect(t, second, "added-after-stop")
+	select {
+	case name := <-first:
+		t.Errorf("the removed handler was notified of %s", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func notify(names chan<- string) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			names <- obj.(*corev1.ConfigMap).Name
+		},
+	}
+}
+
+func expect(t *testing.T, names <-chan string, want string) {
+	t.Helper()
+	select {
+	case name := <-names:
+		if name != want {
+			t.Errorf("notified of %s, want %s", name, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("not notified of %s", want)
+	}
+}
+
+func makeConfigMap(name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+		},
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/logging"
+
+	"github.com/lionelvillard/knative-functions-controller/pkg/dynamic"
+	"github.com/lionelvillard/knative-functions-controller/pkg/dynamic/factory"
+	"github.com/lionelvillard/knative-functions-controller/pkg/leaderelection"
+)
+
+// ControllerConstructor creates a controller constructor for the given function resource.
+type ControllerConstructor func(gvr schema.GroupVersionResource) injection.ControllerConstructor
+
+// InstancesHandler is called with the name of a function CRD when one of
+// its instances is added or deleted.
+type InstancesHandler func(name string)
+
+// Manager starts and stops function controllers at runtime, as function
+// CRDs are added to and removed from the cluster.
+type Manager struct {
+	ctx         context.Context
+	cmw         configmap.Watcher
+	constructor ControllerConstructor
+	handler     InstancesHandler
+
+	lock sync.Mutex
+	// controllers is indexed by CRD name
+	controllers map[string]*runningController
+}
+
+type runningController struct {
+	gvr      schema.GroupVersionResource
+	ctx      context.Context
+	informer cache.SharedIndexInformer
+	cancel   context.CancelFunc
+
+	// impl is nil until the controller is started. done is closed once
+	// the started controller returns.
+	impl *controller.Impl
+	done chan struct{}
+}
+
+// New creates a Manager. Controllers started by the manager are stopped
+// when ctx is done. The handler may be nil.
+//
+// Controllers started by the manager add handlers to the shared informers
+// with AddEventHandler, so that they are removed when the controllers stop.
+func New(ctx context.Context, cmw configmap.Watcher, constructor ControllerConstructor, handler InstancesHandler) *Manager {
+	return &Manager{
+		ctx:         context.WithValue(ctx, handlersKey{}, newHandlers()),
+		cmw:         cmw,
+		constructor: constructor,
+		handler:     handler,
+		controllers: make(map[string]*runningController),
+	}
+}
+
+// Watch starts the dynamic informer for the function CRD called name, if
+// not already running, without reconciling the function instances. An
+// informer running for another resource under the same name is stopped
+// first.
+func (m *Manager) Watch(name string, gvr schema.GroupVersionResource) {
+	m.lock.Lock()
+	_, stopped := m.watch(name, gvr)
+	m.lock.Unlock()
+
+	stopped.wait()
+}
+
+// Start starts the controller and the dynamic informer for the function CRD
+// called name, if not already running. A controller running for another
+// resource under the same name is stopped first.
+func (m *Manager) Start(name string, gvr schema.GroupVersionResource) {
+	m.lock.Lock()
+	stopped := m.start(name, gvr)
+	m.lock.Unlock()
+
+	stopped.wait()
+}
+
+// start starts the controller for the function CRD called name and returns
+// the controller it replaces, if any.
+func (m *Manager) start(name string, gvr schema.GroupVersionResource) *runningController {
+	rc, stopped := m.watch(name, gvr)
+	if rc.impl != nil {
+		return stopped
+	}
+
+	logger := logging.FromContext(rc.ctx)
+	logger.Info("Starting function controller")
+
+	impl := m.constructor(gvr)(rc.ctx, m.cmw)
+	// Function controllers only reconcile while the CRD controller leads.
+	impl.Reconciler = leaderelection.Gate(rc.ctx, impl.Reconciler)
+	rc.impl = impl
+	rc.done = make(chan struct{})
+
+	go func() {
+		defer close(rc.done)
+		if ok := cache.WaitForCacheSync(rc.ctx.Done(), rc.informer.HasSynced); !ok {
+			logger.Info("Function controller stopped before its informer synced")
+			return
+		}
+		if err := impl.Run(controller.DefaultThreadsPerController, rc.ctx.Done()); err != nil {
+			logger.Errorw("Function controller failed", zap.Error(err))
+		}
+	}()
+	return stopped
+}
+
+// watch starts the dynamic informer for the function CRD called name, if
+// not already running, and returns its running controller along with the
+// controller it replaces, if any.
+func (m *Manager) watch(name string, gvr schema.GroupVersionResource) (*runningController, *runningController) {
+	var stopped *runningController
+	if rc, ok := m.controllers[name]; ok {
+		if rc.gvr == gvr {
+			return rc, nil
+		}
+		m.stop(name, rc)
+		stopped = rc
+	}
+
+	logger := logging.FromContext(m.ctx).With(zap.String("crd", name), zap.Any("gvr", gvr))
+	logger.Info("Starting function informer")
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	ctx = logging.WithLogger(ctx, logger)
+
+	ctx, _ = dynamic.WithInformer(gvr)(ctx)
+	informer := dynamic.Get(ctx, gvr).Informer()
+
+	rc := &runningController{
+		gvr:      gvr,
+		ctx:      ctx,
+		informer: informer,
+		cancel:   cancel,
+	}
+	m.controllers[name] = rc
+
+	if m.handler != nil {
+		notify := func(interface{}) { m.handler(name) }
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    notify,
+			DeleteFunc: notify,
+		})
+	}
+
+	go informer.Run(ctx.Done())
+	return rc, stopped
+}
+
+// Resync enqueues all function instances of all running controllers.
+func (m *Manager) Resync() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, rc := range m.controllers {
+		if rc.impl != nil {
+			rc.impl.GlobalResync(rc.informer)
+		}
+	}
+}
+
+// ResyncController enqueues all function instances of the controller for the
+// function CRD called name.
+func (m *Manager) ResyncController(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if rc, ok := m.controllers[name]; ok && rc.impl != nil {
+		rc.impl.GlobalResync(rc.informer)
+	}
+}
+
+// Instances returns the number of instances of the function CRD called name
+// known by its informer. It returns false when the informer is not running
+// or has not synced yet.
+func (m *Manager) Instances(name string) (int, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	rc, ok := m.controllers[name]
+	if !ok || !rc.informer.HasSynced() {
+		return 0, false
+	}
+	return len(rc.informer.GetStore().ListKeys()), true
+}
+
+// Stop stops the controller and the dynamic informer for the function CRD called name.
+// It blocks until in-flight reconciliations are done.
+func (m *Manager) Stop(name string) {
+	m.lock.Lock()
+	rc, ok := m.controllers[name]
+	if ok {
+		m.stop(name, rc)
+	}
+	m.lock.Unlock()
+
+	// In-flight reconciliations may call the manager.
+	rc.wait()
+}
+
+// stop cancels rc and removes it from the manager. The caller waits for rc
+// after releasing the lock.
+func (m *Manager) stop(name string, rc *runningController) {
+	logging.FromContext(m.ctx).Infow("Stopping function controller", zap.String("crd", name), zap.Any("gvr", rc.gvr))
+
+	rc.cancel()
+	factory.Get(m.ctx).Forget(rc.gvr)
+	delete(m.controllers, name)
+}
+
+// wait blocks until the started controller rc returns. rc may be nil.
+func (rc *runningController) wait() {
+	if rc != nil && rc.impl != nil {
+		<-rc.done
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package names computes the names of the runtime resources created for
+// each function kind and function instance.
+package names
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"knative.dev/pkg/kmeta"
+
+	duckv1alpha1 "github.com/lionelvillard/knative-functions-controller/pkg/apis/duck/v1alpha1"
+)
+
+// ServiceName returns the name of the Knative service shared by all
+// instances of the function kind gr.
+//
+// Kinds in the functions.knative.dev group keep their plural name. Kinds in
+// other groups are suffixed by a hash of their group so that kinds with
+// the same plural in different groups do not collide.
+func ServiceName(gr schema.GroupResource) string {
+	if gr.Group == duckv1alpha1.GroupName {
+		return gr.Resource
+	}
+	return kmeta.ChildName(gr.Resource, "-"+shortHash(gr.Group))
+}
+
+// ServiceShardName returns the name of the Knative service index among
+// the services serving the instances of the function kind gr. The first
+// service is the one returned by ServiceName.
+func ServiceShardName(gr schema.GroupResource, index int) string {
+	if index == 0 {
+		return ServiceName(gr)
+	}
+	return kmeta.ChildName(ServiceName(gr), fmt.Sprintf("-%d", index))
+}
+
+// ConfigMapName returns the name of the configmap holding the configuration
+// of the instances served by the Knative service called service.
+func ConfigMapName(service string) string {
+	return "config-function-" + service
+}
+
+// ConfigMapShardName returns the name of the configmap holding the shard
+// index of the configuration of the instances served by the Knative
+// service called service. The first shard is the configmap returned by
+// ConfigMapName.
+//
+// The shard infix keeps the shards of a service apart from the first shard
+// of the other services of the kind, returned by ServiceShardName.
+func ConfigMapShardName(service string, index int) string {
+	if index == 0 {
+		return ConfigMapName(service)
+	}
+	return fmt.Sprintf("%s-shard-%d", ConfigMapName(service), index)
+}
+
+// RouteName returns the name of the route of the function instance namespace/name.
+// The namespace is empty for cluster-scoped functions.
+func RouteName(gr schema.GroupResource, namespace, name string) string {
+	if namespace == "" {
+		return kmeta.ChildName(ServiceName(gr)+"-", name)
+	}
+	return kmeta.ChildName(fmt.Sprintf("%s-%s-", ServiceName(gr), namespace), name)
+}
+
+// DedicatedServiceName returns the name of the Knative service dedicated to
+// the function instance namespace/name. Knative services create a route with
+// their own name, so it must differ from the route names of all instances.
+// A fixed suffix appended to the route name can form the route name of
+// another instance, so the suffix ends with a hash of the route name.
+func DedicatedServiceName(gr schema.GroupResource, namespace, name string) string {
+	route := RouteName(gr, namespace, name)
+	return kmeta.ChildName(route, "-dedicated-"+shortHash(route))
+}
+
+func shortHash(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))[:8]
+}
@@ -0,0 +1,538 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shards
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/retry"
+	"knative.dev/pkg/logging"
+
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
+)
+
+// Client reads and writes the configuration shards of the instances
+// served by a Knative service.
+//
+// Shards are read from the lister and written with merge patches. Writes
+// failing because a shard changed concurrently are retried with shards read
+// from the API server.
+type Client struct {
+	client    corev1client.ConfigMapsGetter
+	lister    corev1listers.ConfigMapLister
+	namespace string
+	service   string
+}
+
+// NewClient creates a Client for the shards of the Knative service called
+// service. Shards are stored in namespace.
+func NewClient(client corev1client.ConfigMapsGetter, lister corev1listers.ConfigMapLister, namespace string, service string) *Client {
+	return &Client{
+		client:    client,
+		lister:    lister,
+		namespace: namespace,
+		service:   service,
+	}
+}
+
+// shard is a configmap and its serialized configurations, by key.
+type shard struct {
+	cm      *corev1.ConfigMap
+	entries map[string]string
+	dirty   bool
+
+	// count is the number of shards to record in the first shard, if not 0.
+	count int
+
+	// locked makes the write fail when the shard changed since it was read.
+	locked bool
+}
+
+// Get returns all shards, ordered by index. Shards not created yet are
+// returned empty. It fails when the first shard does not exist.
+func (c *Client) Get() ([]*corev1.ConfigMap, error) {
+	shards, _, err := c.get(false)
+	if err != nil {
+		return nil, err
+	}
+	return configMaps(shards), nil
+}
+
+// Set stores value under key, splitting the shards when the shard holding
+// key grows above SplitSize. It returns the updated shards.
+func (c *Client) Set(ctx context.Context, key string, value interface{}) ([]*corev1.ConfigMap, error) {
+	return c.Update(ctx, map[string]interface{}{key: value})
+}
+
+// Remove removes the configuration stored under key, merging the shards
+// when they are mostly empty. It returns the updated shards, or nil when
+// the first shard does not exist.
+func (c *Client) Remove(ctx context.Context, key string) ([]*corev1.ConfigMap, error) {
+	cms, err := c.Update(ctx, map[string]interface{}{key: nil})
+	if apierrs.IsNotFound(err) {
+		return nil, nil
+	}
+	return cms, err
+}
+
+// Update stores the values of changes under their key, at once. Keys with
+// a nil value are removed. The shards are split when one of them grows
+// above SplitSize and merged when they are mostly empty. It returns the
+// updated shards.
+func (c *Client) Update(ctx context.Context, changes map[string]interface{}) ([]*corev1.ConfigMap, error) {
+	raws := make(map[string]*string, len(changes))
+	for key, value := range changes {
+		if value == nil {
+			raws[key] = nil
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		str := string(raw)
+		raws[key] = &str
+	}
+
+	return c.retry(func(live bool) ([]*corev1.ConfigMap, error) {
+		return c.update(ctx, live, raws)
+	})
+}
+
+func (c *Client) update(ctx context.Context, live bool, changes map[string]*string) ([]*corev1.ConfigMap, error) {
+	shards, format, err := c.get(live)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shards storing new or changed configurations.
+	targets := make(map[int]bool)
+	removed := false
+	for key, raw := range changes {
+		index := -1
+		if raw != nil {
+			index = Index(key, len(shards))
+		}
+		for i, s := range shards {
+			old, ok := s.entries[key]
+			if i == index {
+				if !ok || old != *raw {
+					s.entries[key] = *raw
+					s.dirty = true
+					targets[i] = true
+				}
+			} else if ok {
+				// The configuration was removed, or stored in another
+				// shard before the last rebalance.
+				delete(s.entries, key)
+				s.dirty = true
+				removed = removed || raw == nil
+			}
+		}
+	}
+
+	for i := range targets {
+		if entriesSize(shards[i].entries) > SplitSize && len(shards) < MaxCount {
+			return c.rebalance(ctx, shards, format, len(shards)*2)
+		}
+	}
+
+	if removed {
+		total := 0
+		for _, s := range shards {
+			total += entriesSize(s.entries)
+		}
+
+		// Halve the number of shards while the remaining shards would stay
+		// half empty.
+		count := len(shards)
+		for count > 1 && total < count/2*SplitSize/2 {
+			count /= 2
+		}
+		if count < len(shards) {
+			return c.rebalance(ctx, shards, format, count)
+		}
+	}
+
+	// Write the shards storing new configurations first so that
+	// configurations are always served by at least one shard.
+	for i := range targets {
+		if err := c.write(ctx, shards[i], format); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range shards {
+		if err := c.write(ctx, s, format); err != nil {
+			return nil, err
+		}
+	}
+	return configMaps(shards), nil
+}
+
+// Migrate rewrites the shards in format. The first shard is rewritten first
+// so that concurrent writers use the new format.
+func (c *Client) Migrate(ctx context.Context, format string) ([]*corev1.ConfigMap, error) {
+	logging.FromContext(ctx).Infow("Migrating function configuration shards",
+		zap.String("service", c.service), zap.String("format", format))
+
+	return c.retry(func(live bool) ([]*corev1.ConfigMap, error) {
+		shards, _, err := c.get(live)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range shards {
+			s.dirty = true
+			if err := c.write(ctx, s, format); err != nil {
+				return nil, err
+			}
+		}
+		return configMaps(shards), nil
+	})
+}
+
+// SetVersion records version in the first shard, stored in EntriesFormat,
+// once the configurations it versions have been written.
+func (c *Client) SetVersion(ctx context.Context, version string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			VersionKey: version,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.ConfigMaps(c.namespace).Patch(c.name(0), types.MergePatchType, patch)
+	return err
+}
+
+// Delete deletes all shards, including the ones left behind by a failed
+// rebalance. It returns the names of the deleted configmaps.
+func (c *Client) Delete() ([]string, error) {
+	count := 1
+	first, err := c.client.ConfigMaps(c.namespace).Get(c.name(0), metav1.GetOptions{})
+	if err != nil {
+		if !apierrs.IsNotFound(err) {
+			return nil, err
+		}
+	} else {
+		count = Count(first)
+	}
+
+	var deleted []string
+	for i := count; i < MaxCount; i++ {
+		ok, err := c.delete(i)
+		if err != nil {
+			return deleted, err
+		}
+		if !ok {
+			break
+		}
+		deleted = append(deleted, c.name(i))
+	}
+
+	// Delete the first shard last to not lose the number of shards.
+	for i := count - 1; i >= 0; i-- {
+		ok, err := c.delete(i)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted = append(deleted, c.name(i))
+		}
+	}
+	return deleted, nil
+}
+
+// delete deletes the shard index. It returns false when the shard does not
+// exist.
+func (c *Client) delete(index int) (bool, error) {
+	err := c.client.ConfigMaps(c.namespace).Delete(c.name(index), &metav1.DeleteOptions{})
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	reportDeleted(context.Background(), c.service, c.name(index))
+	return true, nil
+}
+
+// rebalance redistributes the configurations of shards across count shards.
+func (c *Client) rebalance(ctx context.Context, shards []*shard, format string, count int) ([]*corev1.ConfigMap, error) {
+	logging.FromContext(ctx).Infow("Rebalancing function configuration shards",
+		zap.String("service", c.service), zap.Int("from", len(shards)), zap.Int("to", count))
+
+	next := make([]map[string]string, count)
+	for i := range next {
+		next[i] = make(map[string]string)
+	}
+	for _, s := range shards {
+		for key, value := range s.entries {
+			next[Index(key, count)][key] = value
+		}
+	}
+
+	// Fill the shards other than the first one, keeping the configurations
+	// they already serve. Configurations are served twice until the end of
+	// the rebalance rather than not at all.
+	rebalanced := make([]*shard, count)
+	for i := 1; i < count; i++ {
+		s := &shard{entries: make(map[string]string), dirty: true}
+		if i < len(shards) {
+			s.cm = shards[i].cm
+			for key, value := range shards[i].entries {
+				s.entries[key] = value
+			}
+		} else {
+			// Shards beyond the recorded count are left behind by a
+			// rebalance which failed to write the first shard. They are
+			// not served and are overwritten.
+			cm, err := c.getConfigMap(i, true)
+			if apierrs.IsNotFound(err) {
+				cm = c.makeShard(i, shards[0].cm)
+			} else if err != nil {
+				return nil, err
+			}
+			s.cm = cm
+		}
+		for key, value := range next[i] {
+			s.entries[key] = value
+		}
+		if err := c.write(ctx, s, format); err != nil {
+			return nil, err
+		}
+		rebalanced[i] = s
+	}
+
+	// The first shard records the new layout. The update fails when the
+	// shards have been changed concurrently.
+	first := shards[0]
+	first.count = count
+	first.locked = true
+	first.entries = next[0]
+	first.dirty = true
+	if err := c.write(ctx, first, format); err != nil {
+		return nil, err
+	}
+	rebalanced[0] = first
+
+	// Remove the configurations moved to other shards.
+	for i := 1; i < count; i++ {
+		if len(rebalanced[i].entries) != len(next[i]) {
+			rebalanced[i].entries = next[i]
+			rebalanced[i].dirty = true
+			if err := c.write(ctx, rebalanced[i], format); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := count; i < len(shards); i++ {
+		err := c.client.ConfigMaps(c.namespace).Delete(c.name(i), &metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			return nil, err
+		}
+		reportDeleted(ctx, c.service, c.name(i))
+	}
+
+	return configMaps(rebalanced), nil
+}
+
+// retry runs update until it does not fail because a shard changed
+// concurrently, up to retry.DefaultRetry steps. The first run reads the
+// shards from the lister, the next ones from the API server.
+func (c *Client) retry(update func(live bool) ([]*corev1.ConfigMap, error)) ([]*corev1.ConfigMap, error) {
+	var cms []*corev1.ConfigMap
+	live := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() (err error) {
+		cms, err = update(live)
+		live = true
+		return err
+	})
+	return cms, err
+}
+
+// get returns all shards and the format of the first shard, used to write
+// all shards. Shards are read from the API server when live is true.
+func (c *Client) get(live bool) ([]*shard, string, error) {
+	first, err := c.getConfigMap(0, live)
+	if err != nil {
+		return nil, "", err
+	}
+
+	count := Count(first)
+	shards := make([]*shard, count)
+	for i := range shards {
+		cm := first
+		if i > 0 {
+			cm, err = c.getConfigMap(i, live)
+			if apierrs.IsNotFound(err) {
+				cm = c.makeShard(i, first)
+			} else if err != nil {
+				return nil, "", err
+			}
+		}
+
+		// Shards are decoded with their own format, which differs from the
+		// format of the first shard during a migration.
+		entries, err := decode(cm)
+		if err != nil {
+			return nil, "", err
+		}
+		shards[i] = &shard{cm: cm, entries: entries}
+	}
+	return shards, Format(first), nil
+}
+
+// getConfigMap returns the configmap of the shard index. Shards missing
+// from the lister may have just been created and are read from the API
+// server.
+func (c *Client) getConfigMap(index int, live bool) (*corev1.ConfigMap, error) {
+	if !live {
+		cm, err := c.lister.ConfigMaps(c.namespace).Get(c.name(index))
+		if !apierrs.IsNotFound(err) {
+			return cm, err
+		}
+	}
+	return c.client.ConfigMaps(c.namespace).Get(c.name(index), metav1.GetOptions{})
+}
+
+// write creates or patches the shard in format when it has been changed.
+// Writes failing because the shard was created or deleted concurrently are
+// reported as conflicts.
+func (c *Client) write(ctx context.Context, s *shard, format string) error {
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := encode(s.entries, format)
+	if err != nil {
+		return err
+	}
+
+	var cm *corev1.ConfigMap
+	if s.cm.ResourceVersion == "" {
+		cm = s.cm.DeepCopy()
+		cm.Data = data
+		if cm.Annotations == nil {
+			cm.Annotations = make(map[string]string)
+		}
+		cm.Annotations[FormatAnnotation] = format
+		if s.count > 0 {
+			cm.Annotations[CountAnnotation] = strconv.Itoa(s.count)
+		}
+
+		cm, err = c.client.ConfigMaps(c.namespace).Create(cm)
+		if apierrs.IsAlreadyExists(err) {
+			return apierrs.NewConflict(corev1.Resource("configmaps"), s.cm.Name, err)
+		}
+	} else {
+		var patch []byte
+		patch, err = makePatch(s, data, format)
+		if err != nil {
+			return err
+		}
+
+		cm, err = c.client.ConfigMaps(c.namespace).Patch(s.cm.Name, types.MergePatchType, patch)
+		if apierrs.IsNotFound(err) {
+			return apierrs.NewConflict(corev1.Resource("configmaps"), s.cm.Name, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.cm = cm
+	s.dirty = false
+	reportSize(ctx, c.service, cm)
+	return nil
+}
+
+// makePatch returns a merge patch writing data in format to the shard. Only
+// the changed keys are written so that writes of other keys in EntriesFormat
+// do not conflict. Other writes fail when the shard changed since it was read.
+func makePatch(s *shard, data map[string]string, format string) ([]byte, error) {
+	changes := make(map[string]interface{})
+	for key, value := range data {
+		if old, ok := s.cm.Data[key]; !ok || old != value {
+			changes[key] = value
+		}
+	}
+	for key := range s.cm.Data {
+		if _, ok := data[key]; !ok && (key != VersionKey || format != EntriesFormat) {
+			changes[key] = nil
+		}
+	}
+
+	annotations := map[string]interface{}{
+		FormatAnnotation: format,
+	}
+	if s.count > 0 {
+		annotations[CountAnnotation] = strconv.Itoa(s.count)
+	}
+	metadata := map[string]interface{}{
+		"annotations": annotations,
+	}
+	if s.locked || format != EntriesFormat || Format(s.cm) != format {
+		metadata["resourceVersion"] = s.cm.ResourceVersion
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+		"data":     changes,
+	})
+}
+
+func (c *Client) name(index int) string {
+	return names.ConfigMapShardName(c.service, index)
+}
+
+// makeShard returns the shard index, labelled as the first shard.
+func (c *Client) makeShard(index int, first *corev1.ConfigMap) *corev1.ConfigMap {
+	var labels map[string]string
+	if len(first.Labels) > 0 {
+		labels = make(map[string]string, len(first.Labels))
+		for k, v := range first.Labels {
+			labels[k] = v
+		}
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      c.name(index),
+			Namespace: c.namespace,
+			Labels:    labels,
+		},
+	}
+}
+
+func configMaps(shards []*shard) []*corev1.ConfigMap {
+	cms := make([]*corev1.ConfigMap, len(shards))
+	for i, s := range shards {
+		cms[i] = s.cm
+	}
+	return cms
+}
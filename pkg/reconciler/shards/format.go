@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shards
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// FormatAnnotation records how configurations are stored in a shard.
+	// Shards without it use FileFormat.
+	FormatAnnotation = "functions.knative.dev/config-format"
+
+	// EntriesFormat stores each configuration under its own key. Shards
+	// are mounted as a directory, with one file per configuration.
+	EntriesFormat = "entries"
+
+	// FileFormat stores all configurations in a single JSON document under
+	// ConfigKey, for runtimes only reading ___config.json.
+	FileFormat = "file"
+
+	// VersionKey is the key of the first shard holding the version of the
+	// configuration, for runtimes reloading the configuration files. It is
+	// only written in EntriesFormat.
+	VersionKey = "___version"
+)
+
+// ParseFormat returns the format called name. The empty name selects
+// FileFormat, read by all runtimes.
+func ParseFormat(name string) (string, error) {
+	switch name {
+	case "", FileFormat:
+		return FileFormat, nil
+	case EntriesFormat:
+		return EntriesFormat, nil
+	}
+	return "", fmt.Errorf("unknown configuration format %q", name)
+}
+
+// Format returns the format of the shard.
+func Format(cm *corev1.ConfigMap) string {
+	if cm.Annotations[FormatAnnotation] == EntriesFormat {
+		return EntriesFormat
+	}
+	return FileFormat
+}
+
+// decode returns the serialized configurations stored in the shard, by key.
+func decode(cm *corev1.ConfigMap) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	if Format(cm) == EntriesFormat {
+		for key, value := range cm.Data {
+			if key != VersionKey {
+				entries[key] = value
+			}
+		}
+		return entries, nil
+	}
+
+	raw, ok := cm.Data[ConfigKey]
+	if !ok {
+		return entries, nil
+	}
+	config := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, err
+	}
+	for key, value := range config {
+		entries[key] = string(value)
+	}
+	return entries, nil
+}
+
+// encode returns the data of a shard storing entries in format.
+func encode(entries map[string]string, format string) (map[string]string, error) {
+	data := make(map[string]string)
+
+	if format == EntriesFormat {
+		for key, value := range entries {
+			data[key] = value
+		}
+		return data, nil
+	}
+
+	config := make(map[string]json.RawMessage)
+	for key, value := range entries {
+		config[key] = json.RawMessage(value)
+	}
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	data[ConfigKey] = string(raw)
+	return data, nil
+}
+
+// entriesSize returns the approximate size of the shard storing entries.
+func entriesSize(entries map[string]string) int {
+	size := 0
+	for key, value := range entries {
+		size += len(key) + len(value)
+	}
+	return size
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package shards splits the configuration of the instances of a function
+// kind across several configmaps, to stay below the configmap size limit.
+//
+// Each instance configuration is stored in the shard selected by the hash of
+// its key. The first shard records the number of shards in the
+// CountAnnotation annotation. Shards are split when one of them grows above
+// SplitSize and merged back when they are mostly empty.
+package shards
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ConfigKey is the configmap key holding the configurations of a shard.
+	ConfigKey = "___config.json"
+
+	// CountAnnotation is the annotation of the first shard recording the
+	// number of shards. Configmaps without it are single shards.
+	CountAnnotation = "functions.knative.dev/shards"
+
+	// SplitSize is the size of a shard, in bytes, above which the shards
+	// are split. It is half of the configmap size limit.
+	SplitSize = 512 * 1024
+
+	// WarnSize is the size of a shard, in bytes, above which the shard is
+	// reported as close to the configmap size limit.
+	WarnSize = 768 * 1024
+
+	// MaxCount is the maximum number of shards of a function kind.
+	MaxCount = 64
+)
+
+// Index returns the index of the shard holding key among count shards.
+func Index(key string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(count))
+}
+
+// Count returns the number of shards recorded in the first shard.
+func Count(cm *corev1.ConfigMap) int {
+	count, err := strconv.Atoi(cm.Annotations[CountAnnotation])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// Version returns the version of the configuration stored in shards. It is
+// a hash of the configurations served by the shards, which only changes when
+// one of the configurations changes, independently of how they are stored.
+func Version(cms []*corev1.ConfigMap) (string, error) {
+	// Configurations are stored twice during a rebalance.
+	config := make(map[string]string)
+	for _, cm := range cms {
+		entries, err := decode(cm)
+		if err != nil {
+			return "", err
+		}
+		for key, value := range entries {
+			config[key] = value
+		}
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		var value bytes.Buffer
+		if err := json.Compact(&value, []byte(config[key])); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s=%s\n", key, value.Bytes())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// EntryVersion returns the version of the configuration stored under key in
+// shards, a hash of that configuration. It returns the empty string when no
+// configuration is stored under key.
+func EntryVersion(cms []*corev1.ConfigMap, key string) (string, error) {
+	value, ok, err := Value(cms, key)
+	if err != nil || !ok {
+		return "", err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(value)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(compact.Bytes())), nil
+}
+
+// Size returns the size of the configurations stored in the shard.
+func Size(cm *corev1.ConfigMap) int {
+	size := 0
+	for key, value := range cm.Data {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+// Value returns the serialized configuration stored under key in shards.
+func Value(cms []*corev1.ConfigMap, key string) (string, bool, error) {
+	entries, err := decode(cms[Index(key, len(cms))])
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := entries[key]
+	return value, ok, nil
+}
@@ -0,0 +1,487 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shards
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	ktesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/lionelvillard/knative-functions-controller/pkg/reconciler/names"
+)
+
+const (
+	testNamespace = "knative-functions"
+	testService   = "filters"
+)
+
+// large is a configuration value above a third of SplitSize once serialized.
+var large = strings.Repeat("a", SplitSize/3+1)
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []*corev1.ConfigMap
+		same bool
+	}{{
+		name: "same configurations",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`})},
+		same: true,
+	}, {
+		name: "different formats",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`, "b": `"y"`})},
+		b:    []*corev1.ConfigMap{fileShard(0, map[string]string{"a": `{"x":1}`, "b": `"y"`})},
+		same: true,
+	}, {
+		name: "different spacing",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{ "x": 1 }`})},
+		same: true,
+	}, {
+		name: "different shards",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`, "b": `2`})},
+		b: []*corev1.ConfigMap{
+			entriesShard(0, 2, map[string]string{"a": `1`}),
+			entriesShard(1, 0, map[string]string{"b": `2`}),
+		},
+		same: true,
+	}, {
+		name: "stored twice during a rebalance",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`, "b": `2`})},
+		b: []*corev1.ConfigMap{
+			entriesShard(0, 2, map[string]string{"a": `1`, "b": `2`}),
+			entriesShard(1, 0, map[string]string{"b": `2`}),
+		},
+		same: true,
+	}, {
+		name: "ignores the version key",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`, VersionKey: "v1"})},
+		same: true,
+	}, {
+		name: "different values",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `2`})},
+	}, {
+		name: "different keys",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"b": `1`})},
+	}, {
+		name: "removed configuration",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`, "b": `2`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `1`})},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := Version(test.a)
+			if err != nil {
+				t.Fatalf("Version() = %v", err)
+			}
+			b, err := Version(test.b)
+			if err != nil {
+				t.Fatalf("Version() = %v", err)
+			}
+			if (a == b) != test.same {
+				t.Errorf("Version() = %q and %q, want same = %t", a, b, test.same)
+			}
+		})
+	}
+}
+
+func TestEntryVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []*corev1.ConfigMap
+		same bool
+	}{{
+		name: "other configurations changed",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`, "b": `1`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`, "b": `2`, "c": `3`})},
+		same: true,
+	}, {
+		name: "different formats",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`})},
+		b:    []*corev1.ConfigMap{fileShard(0, map[string]string{"a": `{ "x": 1 }`})},
+		same: true,
+	}, {
+		name: "configuration changed",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":2}`})},
+	}, {
+		name: "configuration removed",
+		a:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"a": `{"x":1}`})},
+		b:    []*corev1.ConfigMap{entriesShard(0, 1, map[string]string{"b": `{"x":1}`})},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := EntryVersion(test.a, "a")
+			if err != nil {
+				t.Fatalf("EntryVersion() = %v", err)
+			}
+			b, err := EntryVersion(test.b, "a")
+			if err != nil {
+				t.Fatalf("EntryVersion() = %v", err)
+			}
+			if a == "" {
+				t.Errorf("EntryVersion() = \"\", want a version")
+			}
+			if (a == b) != test.same {
+				t.Errorf("EntryVersion() = %q and %q, want same = %t", a, b, test.same)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		shards  []*corev1.ConfigMap
+		changes map[string]interface{}
+		// want are the configurations served after the update, by key.
+		want map[string]string
+		// count is the number of shards after the update.
+		count int
+	}{{
+		name:    "add",
+		shards:  []*corev1.ConfigMap{entriesShard(0, 0, map[string]string{"a": `1`})},
+		changes: map[string]interface{}{"b": 2},
+		want:    map[string]string{"a": `1`, "b": `2`},
+		count:   1,
+	}, {
+		name:    "change",
+		shards:  []*corev1.ConfigMap{entriesShard(0, 0, map[string]string{"a": `1`})},
+		changes: map[string]interface{}{"a": 2},
+		want:    map[string]string{"a": `2`},
+		count:   1,
+	}, {
+		name:    "remove",
+		shards:  []*corev1.ConfigMap{entriesShard(0, 0, map[string]string{"a": `1`, "b": `2`})},
+		changes: map[string]interface{}{"b": nil},
+		want:    map[string]string{"a": `1`},
+		count:   1,
+	}, {
+		name:    "file format",
+		shards:  []*corev1.ConfigMap{fileShard(0, map[string]string{"a": `1`})},
+		changes: map[string]interface{}{"a": nil, "b": 2},
+		want:    map[string]string{"b": `2`},
+		count:   1,
+	}, {
+		name:    "batch",
+		shards:  []*corev1.ConfigMap{entriesShard(0, 0, map[string]string{"a": `1`, "b": `2`})},
+		changes: map[string]interface{}{"a": 3, "b": nil, "c": 4},
+		want:    map[string]string{"a": `3`, "c": `4`},
+		count:   1,
+	}, {
+		name:    "split",
+		shards:  []*corev1.ConfigMap{entriesShard(0, 0, map[string]string{"a": strconv.Quote(large), "b": strconv.Quote(large)})},
+		changes: map[string]interface{}{"c": large},
+		want:    map[string]string{"a": strconv.Quote(large), "b": strconv.Quote(large), "c": strconv.Quote(large)},
+		count:   2,
+	}, {
+		name:    "split with other changes",
+		shards:  []*corev1.ConfigMap{entriesShard(0, 0, map[string]string{"a": strconv.Quote(large), "b": strconv.Quote(large)})},
+		changes: map[string]interface{}{"c": large, "d": 1},
+		want:    map[string]string{"a": strconv.Quote(large), "b": strconv.Quote(large), "c": strconv.Quote(large), "d": `1`},
+		count:   2,
+	}, {
+		name: "merge",
+		shards: []*corev1.ConfigMap{
+			entriesShard(0, 2, placed(2, 0, map[string]string{"a": `1`, "b": `2`, "c": `3`, "d": `4`})),
+			entriesShard(1, 0, placed(2, 1, map[string]string{"a": `1`, "b": `2`, "c": `3`, "d": `4`})),
+		},
+		changes: map[string]interface{}{"a": nil},
+		want:    map[string]string{"b": `2`, "c": `3`, "d": `4`},
+		count:   1,
+	}, {
+		name: "change in another shard",
+		shards: []*corev1.ConfigMap{
+			entriesShard(0, 2, placed(2, 0, map[string]string{"a": strconv.Quote(large), "b": strconv.Quote(large), "c": `3`, "d": `4`})),
+			entriesShard(1, 0, placed(2, 1, map[string]string{"a": strconv.Quote(large), "b": strconv.Quote(large), "c": `3`, "d": `4`})),
+		},
+		changes: map[string]interface{}{"c": 5, "d": nil},
+		want:    map[string]string{"a": strconv.Quote(large), "b": strconv.Quote(large), "c": `5`},
+		count:   2,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newClient(test.shards...)
+
+			cms, err := client.Update(context.Background(), test.changes)
+			if err != nil {
+				t.Fatalf("Update() = %v", err)
+			}
+			assertShards(t, cms, test.want, test.count)
+
+			// The shards read back serve the same configurations.
+			cms, err = client.Get()
+			if err != nil {
+				t.Fatalf("Get() = %v", err)
+			}
+			assertShards(t, cms, test.want, test.count)
+			assertNoShard(t, client, test.count)
+		})
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards []*corev1.ConfigMap
+		// count is the number of shards to rebalance to.
+		count int
+		want  map[string]string
+	}{{
+		name:   "split",
+		shards: []*corev1.ConfigMap{entriesShard(0, 0, map[string]string{"a": `1`, "b": `2`, "c": `3`})},
+		count:  4,
+		want:   map[string]string{"a": `1`, "b": `2`, "c": `3`},
+	}, {
+		name: "merge",
+		shards: []*corev1.ConfigMap{
+			entriesShard(0, 2, placed(2, 0, map[string]string{"a": `1`, "b": `2`, "c": `3`})),
+			entriesShard(1, 0, placed(2, 1, map[string]string{"a": `1`, "b": `2`, "c": `3`})),
+		},
+		count: 1,
+		want:  map[string]string{"a": `1`, "b": `2`, "c": `3`},
+	}, {
+		name: "adopt shards left behind",
+		shards: []*corev1.ConfigMap{
+			entriesShard(0, 0, map[string]string{"a": `1`, "b": `2`, "c": `3`}),
+			// Left behind by a rebalance which failed to write the first
+			// shard, with a configuration removed since.
+			entriesShard(1, 0, map[string]string{"stale": `0`}),
+		},
+		count: 2,
+		want:  map[string]string{"a": `1`, "b": `2`, "c": `3`},
+	}, {
+		name: "file format",
+		shards: []*corev1.ConfigMap{
+			fileShard(0, map[string]string{"a": `1`, "b": `2`, "c": `3`}),
+		},
+		count: 2,
+		want:  map[string]string{"a": `1`, "b": `2`, "c": `3`},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newClient(test.shards...)
+
+			shards, format, err := client.get(true)
+			if err != nil {
+				t.Fatalf("get() = %v", err)
+			}
+			cms, err := client.rebalance(context.Background(), shards, format, test.count)
+			if err != nil {
+				t.Fatalf("rebalance() = %v", err)
+			}
+			assertShards(t, cms, test.want, test.count)
+			assertNoShard(t, client, test.count)
+
+			for _, cm := range cms {
+				if Format(cm) != format {
+					t.Errorf("Format(%s) = %s, want %s", cm.Name, Format(cm), format)
+				}
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	client := newClient(
+		entriesShard(0, 2, nil),
+		entriesShard(1, 0, nil),
+		// Left behind by a rebalance which failed to write the first shard.
+		entriesShard(2, 0, nil),
+		entriesShard(3, 0, nil),
+	)
+
+	deleted, err := client.Delete()
+	if err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if len(deleted) != 4 {
+		t.Errorf("Delete() = %v, want 4 shards", deleted)
+	}
+	// The first shard is deleted last.
+	if got, want := deleted[len(deleted)-1], client.name(0); got != want {
+		t.Errorf("last deleted shard = %s, want %s", got, want)
+	}
+	for i := 0; i < 4; i++ {
+		_, err := client.client.ConfigMaps(testNamespace).Get(client.name(i), metav1.GetOptions{})
+		if !apierrs.IsNotFound(err) {
+			t.Errorf("Get(%s) = %v, want not found", client.name(i), err)
+		}
+	}
+}
+
+// newClient returns a client of the shards of testService stored in a fake
+// API server holding cms. The lister is empty so that shards are read from
+// the API server.
+func newClient(cms ...*corev1.ConfigMap) *Client {
+	objects := make([]runtime.Object, len(cms))
+	for i, cm := range cms {
+		objects[i] = cm
+	}
+	kubeClient := fake.NewSimpleClientset(objects...)
+
+	// The fake API server does not set resource versions, which tell
+	// whether a shard exists.
+	kubeClient.PrependReactor("create", "configmaps", func(action ktesting.Action) (bool, runtime.Object, error) {
+		action.(ktesting.CreateAction).GetObject().(*corev1.ConfigMap).ResourceVersion = "1"
+		return false, nil, nil
+	})
+
+	// The fake API server decodes merge patches over the stored object,
+	// keeping the keys they remove.
+	kubeClient.PrependReactor("patch", "configmaps", func(action ktesting.Action) (bool, runtime.Object, error) {
+		patch := action.(ktesting.PatchAction)
+		gvr := corev1.SchemeGroupVersion.WithResource("configmaps")
+		obj, err := kubeClient.Tracker().Get(gvr, patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		old, err := json.Marshal(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		modified, err := jsonpatch.MergePatch(old, patch.GetPatch())
+		if err != nil {
+			return true, nil, err
+		}
+		cm := &corev1.ConfigMap{}
+		if err := json.Unmarshal(modified, cm); err != nil {
+			return true, nil, err
+		}
+		return true, cm, kubeClient.Tracker().Update(gvr, cm, patch.GetNamespace())
+	})
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	return NewClient(kubeClient.CoreV1(), corev1listers.NewConfigMapLister(indexer), testNamespace, testService)
+}
+
+// entriesShard returns the shard index storing entries in EntriesFormat.
+// The first shard records count when not 0.
+func entriesShard(index, count int, entries map[string]string) *corev1.ConfigMap {
+	cm := makeConfigMap(index, count, EntriesFormat)
+	for key, value := range entries {
+		cm.Data[key] = value
+	}
+	return cm
+}
+
+// fileShard returns the single shard index storing entries in FileFormat.
+func fileShard(index int, entries map[string]string) *corev1.ConfigMap {
+	cm := makeConfigMap(index, 0, FileFormat)
+	data, err := encode(entries, FileFormat)
+	if err != nil {
+		panic(err)
+	}
+	cm.Data = data
+	return cm
+}
+
+func makeConfigMap(index, count int, format string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            names.ConfigMapShardName(testService, index),
+			Namespace:       testNamespace,
+			ResourceVersion: "1",
+			Annotations: map[string]string{
+				FormatAnnotation: format,
+			},
+		},
+		Data: make(map[string]string),
+	}
+	if count > 0 {
+		cm.Annotations[CountAnnotation] = strconv.Itoa(count)
+	}
+	return cm
+}
+
+// placed returns the entries stored in the shard index among count shards.
+func placed(count, index int, entries map[string]string) map[string]string {
+	shard := make(map[string]string)
+	for key, value := range entries {
+		if Index(key, count) == index {
+			shard[key] = value
+		}
+	}
+	return shard
+}
+
+// assertShards checks that cms are count shards serving want, each
+// configuration stored in the shard selected by its key.
+func assertShards(t *testing.T, cms []*corev1.ConfigMap, want map[string]string, count int) {
+	t.Helper()
+
+	if len(cms) != count {
+		t.Fatalf("got %d shards, want %d", len(cms), count)
+	}
+	if got := Count(cms[0]); got != count {
+		t.Errorf("Count() = %d, want %d", got, count)
+	}
+
+	for i, cm := range cms {
+		entries, err := decode(cm)
+		if err != nil {
+			t.Fatalf("decode(%s) = %v", cm.Name, err)
+		}
+		for key, value := range entries {
+			if Index(key, count) != i {
+				t.Errorf("shard %d stores %q, want shard %d", i, key, Index(key, count))
+			} else if want[key] != value {
+				t.Errorf("shard %d stores %q = %s, want %s", i, key, value, want[key])
+			}
+		}
+	}
+
+	for key, value := range want {
+		got, ok, err := Value(cms, key)
+		if err != nil {
+			t.Fatalf("Value(%q) = %v", key, err)
+		}
+		if !ok || got != value {
+			t.Errorf("Value(%q) = %s, %t, want %s", key, got, ok, value)
+		}
+	}
+}
+
+// assertNoShard checks that no shard beyond the first count ones exists.
+func assertNoShard(t *testing.T, client *Client, count int) {
+	t.Helper()
+
+	_, err := client.client.ConfigMaps(testNamespace).Get(client.name(count), metav1.GetOptions{})
+	if !apierrs.IsNotFound(err) {
+		t.Errorf("Get(%s) = %v, want not found", client.name(count), err)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shards
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/metrics"
+)
+
+var (
+	shardSizeStat = stats.Int64("config_shard_size", "Size of a function configuration shard", stats.UnitBytes)
+
+	serviceTagKey = tag.MustNewKey("service")
+	shardTagKey   = tag.MustNewKey("shard")
+)
+
+func init() {
+	err := view.Register(&view.View{
+		Description: shardSizeStat.Description(),
+		Measure:     shardSizeStat,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{serviceTagKey, shardTagKey},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// reportSize records the size of the shard and warns when it gets close to
+// the configmap size limit.
+func reportSize(ctx context.Context, service string, cm *corev1.ConfigMap) {
+	size := Size(cm)
+	if size > WarnSize {
+		logging.FromContext(ctx).Warnw("Function configuration shard is close to the configmap size limit",
+			zap.String("configmap", cm.Name), zap.Int("size", size))
+	}
+
+	recordSize(ctx, service, cm.Name, size)
+}
+
+// reportDeleted records the size of the deleted shard called name as 0.
+func reportDeleted(ctx context.Context, service, name string) {
+	recordSize(ctx, service, name, 0)
+}
+
+func recordSize(ctx context.Context, service, name string, size int) {
+	ctx, err := tag.New(ctx, tag.Insert(serviceTagKey, service), tag.Insert(shardTagKey, name))
+	if err != nil {
+		logging.FromContext(ctx).Errorw("Failed to tag the shard size", zap.Error(err))
+		return
+	}
+	metrics.Record(ctx, shardSizeStat.M(int64(size)))
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shards
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	mountDirectory = "/ko-app/"
+
+	// EntriesDirectory is the directory where the runtime reads the
+	// configurations stored in EntriesFormat, one file per configuration.
+	EntriesDirectory = "/ko-app/config"
+)
+
+// FileName returns the name of the file where the runtime reads the shard
+// index stored in FileFormat.
+func FileName(index int) string {
+	if index == 0 {
+		return ConfigKey
+	}
+	return fmt.Sprintf("___config-%d.json", index)
+}
+
+// Volume returns the volume projecting the shards called configMapNames
+// into the runtime container, and the mounts of that volume.
+//
+// In EntriesFormat, all shards are mounted in EntriesDirectory. In
+// FileFormat, a single shard is mounted as /ko-app/___config.json. When
+// there are more shards, shard i is mounted as /ko-app/___config-i.json.
+func Volume(configMapNames []string, format string) (corev1.Volume, []corev1.VolumeMount) {
+	volume := corev1.Volume{
+		Name: configMapNames[0],
+	}
+	mounts := []corev1.VolumeMount{{
+		Name:      configMapNames[0],
+		MountPath: mountDirectory + ConfigKey,
+		SubPath:   ConfigKey,
+	}}
+	if format == EntriesFormat {
+		// Files are updated in place when not mounted with a sub path.
+		mounts = []corev1.VolumeMount{{
+			Name:      configMapNames[0],
+			MountPath: EntriesDirectory,
+			ReadOnly:  true,
+		}}
+	}
+
+	if len(configMapNames) == 1 {
+		volume.VolumeSource = corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: configMapNames[0],
+				},
+			},
+		}
+		return volume, mounts
+	}
+
+	optional := true
+	projected := &corev1.ProjectedVolumeSource{}
+	for i, name := range configMapNames {
+		source := &corev1.ConfigMapProjection{
+			LocalObjectReference: corev1.LocalObjectReference{
+				Name: name,
+			},
+			// Shards are created after the service references them.
+			Optional: &optional,
+		}
+		projected.Sources = append(projected.Sources, corev1.VolumeProjection{
+			ConfigMap: source,
+		})
+		if format == EntriesFormat {
+			continue
+		}
+
+		source.Items = []corev1.KeyToPath{{
+			Key:  ConfigKey,
+			Path: FileName(i),
+		}}
+		if i > 0 {
+			mounts = append(mounts, corev1.VolumeMount{
+				Name:      configMapNames[0],
+				MountPath: mountDirectory + FileName(i),
+				SubPath:   FileName(i),
+			})
+		}
+	}
+	volume.VolumeSource = corev1.VolumeSource{
+		Projected: projected,
+	}
+	return volume, mounts
+}
+
+// Projects returns true when the pod spec mounts the volume projecting
+// exactly the shards called configMapNames in format.
+func Projects(spec corev1.PodSpec, configMapNames []string, format string) bool {
+	if len(spec.Containers) == 0 {
+		return false
+	}
+	_, expected := Volume(configMapNames, format)
+	mounts := []corev1.VolumeMount{}
+	for _, mount := range spec.Containers[0].VolumeMounts {
+		if mount.Name == configMapNames[0] {
+			mounts = append(mounts, mount)
+		}
+	}
+	if len(mounts) != len(expected) {
+		return false
+	}
+	for i := range mounts {
+		if mounts[i].MountPath != expected[i].MountPath || mounts[i].SubPath != expected[i].SubPath {
+			return false
+		}
+	}
+
+	for _, volume := range spec.Volumes {
+		if volume.Name != configMapNames[0] {
+			continue
+		}
+		if len(configMapNames) == 1 {
+			return volume.ConfigMap != nil && volume.ConfigMap.Name == configMapNames[0]
+		}
+		if volume.Projected == nil || len(volume.Projected.Sources) != len(configMapNames) {
+			return false
+		}
+		for i, source := range volume.Projected.Sources {
+			if source.ConfigMap == nil || source.ConfigMap.Name != configMapNames[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}